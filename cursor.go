@@ -0,0 +1,298 @@
+package goat
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrInvalidCursor is returned when a cursor is malformed, its signature does not
+// match or it was issued for a different sort
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// errPageSize is returned when a keyset page size is not positive
+var errPageSize = errors.New("keyset pagination requires a positive page size")
+
+// Cursor is the position of a page in a keyset paginated query: the values of the
+// sort fields of the row it starts after (or before, if Backward). Sort records the
+// sort the cursor was issued for, as "field,asc" or "field,desc" entries, so that
+// it is not applied to a different one.
+type Cursor struct {
+	Key      []interface{} `json:"k"`
+	Sort     []string      `json:"s"`
+	Backward bool          `json:"b,omitempty"`
+}
+
+// CursorCodec encodes the cursors as opaque tokens, signed with the key so that
+// clients cannot forge them
+type CursorCodec struct {
+	Key []byte
+}
+
+// Encode returns the token of the cursor
+func (c CursorCodec) Encode(cur Cursor) (string, error) {
+	if len(c.Key) == 0 {
+		return "", errors.New("cursor key is required")
+	}
+
+	payload, err := json.Marshal(cur)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(c.sign(payload)), nil
+}
+
+// Decode returns the cursor of the token, verifying its signature. Numbers in the
+// key are decoded as strings, not to lose precision
+func (c CursorCodec) Decode(token string) (Cursor, error) {
+	var cur Cursor
+	if len(c.Key) == 0 {
+		return cur, errors.New("cursor key is required")
+	}
+
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return cur, ErrInvalidCursor
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(token[:i])
+	if err != nil {
+		return cur, ErrInvalidCursor
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(sig, c.sign(payload)) {
+		return cur, ErrInvalidCursor
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&cur); err != nil {
+		return cur, ErrInvalidCursor
+	}
+
+	for i, v := range cur.Key {
+		if n, ok := v.(json.Number); ok {
+			cur.Key[i] = n.String()
+		}
+	}
+
+	return cur, nil
+}
+
+func (c CursorCodec) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, c.Key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// GetCursor returns the cursor of the "cursor" query parameter, or nil if the first
+// page is requested
+func (c CursorCodec) GetCursor(ctx *gin.Context) (*Cursor, error) {
+	token := ctx.Query("cursor")
+	if token == "" {
+		return nil, nil
+	}
+
+	cur, err := c.Decode(token)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cur, nil
+}
+
+// CursorPage defines a page of data of a keyset paginated query. Next and Prev are
+// the cursors of the following and preceding pages, empty if there are none
+type CursorPage[T any] struct {
+	Size    int    `json:"size"`
+	Next    string `json:"next,omitempty"`
+	Prev    string `json:"prev,omitempty"`
+	Content []T    `json:"content"`
+}
+
+// Keyset paginates a query by the values of the sort fields, seeking the rows
+// following the cursor instead of skipping an offset. The last sort field must be
+// unique, e.g. the primary key, so that the order is total.
+//
+//	k := goat.Keyset{Orders: p.Sort, Columns: cols, Size: p.Size, Cursor: cur}
+//	where, args, err := k.Where(args)
+//	orderBy, err := k.OrderBy()
+//	limit, args := k.Limit(args)
+type Keyset struct {
+	Orders  []Order
+	Columns Columns
+	Size    int
+
+	// Cursor of the requested page, nil for the first one
+	Cursor *Cursor
+}
+
+// backward tells whether the rows preceding the cursor are requested
+func (k Keyset) backward() bool {
+	return k.Cursor != nil && k.Cursor.Backward
+}
+
+// sort returns the sort of the keyset as recorded in its cursors
+func (k Keyset) sort() []string {
+	orders := make([]string, 0, len(k.Orders))
+	for _, o := range k.Orders {
+		dir := ",asc"
+		if o.Desc {
+			dir = ",desc"
+		}
+		orders = append(orders, o.Field+dir)
+	}
+	return orders
+}
+
+// matches tells whether the cursor was issued for the sort of the keyset
+func (k Keyset) matches(cur *Cursor) bool {
+	orders := k.sort()
+	if len(cur.Key) != len(orders) || len(cur.Sort) != len(orders) {
+		return false
+	}
+
+	for i := range orders {
+		if cur.Sort[i] != orders[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Where returns the seek predicate selecting the rows following the cursor, and the
+// args with the cursor key appended. The predicate is empty for the first page. A
+// cursor issued for a different sort is rejected with ErrInvalidCursor.
+func (k Keyset) Where(args []interface{}) (string, []interface{}, error) {
+	if len(k.Orders) == 0 {
+		return "", nil, errors.New("keyset pagination requires a sort")
+	}
+
+	if k.Size <= 0 {
+		return "", nil, errPageSize
+	}
+
+	if k.Cursor == nil {
+		return "", args, nil
+	}
+
+	if !k.matches(k.Cursor) {
+		return "", nil, ErrInvalidCursor
+	}
+
+	cols := make([]string, 0, len(k.Orders))
+	placeholders := make([]string, 0, len(k.Orders))
+	for i, o := range k.Orders {
+		col, ok := k.Columns[o.Field]
+		if !ok {
+			return "", nil, fmt.Errorf("cannot sort by %s", o.Field)
+		}
+
+		args = append(args, k.Cursor.Key[i])
+		cols = append(cols, col)
+		placeholders = append(placeholders, "$"+strconv.Itoa(len(args)))
+	}
+
+	// (a > $1) OR (a = $1 AND b > $2) OR ..., with the comparison of each field
+	// following its direction
+	terms := make([]string, 0, len(k.Orders))
+	for i, o := range k.Orders {
+		conds := make([]string, 0, i+1)
+		for j := 0; j < i; j++ {
+			conds = append(conds, cols[j]+" = "+placeholders[j])
+		}
+
+		op := ">"
+		if o.Desc != k.backward() {
+			op = "<"
+		}
+		conds = append(conds, cols[i]+" "+op+" "+placeholders[i])
+		terms = append(terms, "("+strings.Join(conds, " AND ")+")")
+	}
+
+	return "(" + strings.Join(terms, " OR ") + ")", args, nil
+}
+
+// OrderBy returns the ORDER BY clause of the query, reversed when the rows
+// preceding the cursor are requested
+func (k Keyset) OrderBy() (string, error) {
+	orders := make([]Order, 0, len(k.Orders))
+	for _, o := range k.Orders {
+		orders = append(orders, Order{Field: o.Field, Desc: o.Desc != k.backward()})
+	}
+
+	return Pageable{Sort: orders}.OrderBy(k.Columns)
+}
+
+// Limit returns the LIMIT clause of the query, fetching one row more than the page
+// size to find out whether another page follows, and the args with the limit
+// appended. A size that is not positive, rejected by Where, counts as zero.
+func (k Keyset) Limit(args []interface{}) (string, []interface{}) {
+	size := k.Size
+	if size < 0 {
+		size = 0
+	}
+
+	args = append(args, size+1)
+	return " LIMIT $" + strconv.Itoa(len(args)), args
+}
+
+// NewCursorPage creates the page out of the rows fetched with the keyset query,
+// where key returns the values of the sort fields of a row
+func NewCursorPage[T any](k Keyset, codec CursorCodec, rows []T, key func(T) []interface{}) (CursorPage[T], error) {
+	page := CursorPage[T]{Size: k.Size}
+	if k.Size <= 0 {
+		return page, errPageSize
+	}
+
+	more := len(rows) > k.Size
+	if more {
+		rows = rows[:k.Size]
+	}
+
+	content := make([]T, len(rows))
+	copy(content, rows)
+	if k.backward() {
+		for i, j := 0, len(content)-1; i < j; i, j = i+1, j-1 {
+			content[i], content[j] = content[j], content[i]
+		}
+	}
+	page.Content = content
+
+	if len(content) == 0 {
+		return page, nil
+	}
+
+	// moving backward, the rows following the page are the ones already seen
+	hasNext := more
+	hasPrev := k.Cursor != nil
+	if k.backward() {
+		hasNext, hasPrev = hasPrev, more
+	}
+
+	var err error
+	if hasNext {
+		if page.Next, err = codec.Encode(Cursor{Key: key(content[len(content)-1]), Sort: k.sort()}); err != nil {
+			return page, err
+		}
+	}
+
+	if hasPrev {
+		if page.Prev, err = codec.Encode(Cursor{Key: key(content[0]), Sort: k.sort(), Backward: true}); err != nil {
+			return page, err
+		}
+	}
+
+	return page, nil
+}
@@ -0,0 +1,181 @@
+package goat
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DomainRule maps the domains matching a regular expression to the tenant whose
+// name is built from the captures of the expression. Rules are evaluated in order,
+// after the tenant domains: a domain is resolved by the first rule matching it and
+// expanding to the name of a registered tenant. Since domains are matched
+// lowercased, the expanded name is compared to the tenant names ignoring case.
+type DomainRule struct {
+	// Pattern is matched against the whole normalized domain, e.g.
+	// `(?P<tenant>[a-z0-9-]+)\.example\.com`
+	Pattern string `yaml:"pattern"`
+
+	// Tenant is the tenant name template, expanded with the captures as
+	// regexp.Expand does, e.g. "$1" or "${tenant}". If not set, the capture named
+	// "tenant" or else the first capture is used
+	Tenant string `yaml:"tenant,omitempty"`
+}
+
+// domainRule is a compiled DomainRule
+type domainRule struct {
+	re     *regexp.Regexp
+	tenant string
+}
+
+// compileRules compiles the domain rules
+func compileRules(rules []DomainRule) ([]domainRule, error) {
+	compiled := make([]domainRule, 0, len(rules))
+	for _, r := range rules {
+		re, err := regexp.Compile("^(?:" + r.Pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("domain rule %s: %w", r.Pattern, err)
+		}
+
+		tenant := r.Tenant
+		if tenant == "" {
+			switch {
+			case re.SubexpIndex("tenant") >= 0:
+				tenant = "${tenant}"
+			case re.NumSubexp() > 0:
+				tenant = "${1}"
+			default:
+				return nil, fmt.Errorf("domain rule %s captures no tenant name", r.Pattern)
+			}
+		}
+
+		compiled = append(compiled, domainRule{re: re, tenant: tenant})
+	}
+	return compiled, nil
+}
+
+// normalizeDomain lowercases the domain and removes the port and the trailing dot
+func normalizeDomain(domain string) string {
+	domain = strings.TrimSpace(domain)
+	if h, _, err := net.SplitHostPort(domain); err == nil {
+		domain = h
+	}
+
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+// wildcard maps the subdomains of a domain to a tenant
+type wildcard struct {
+	// suffix is the domain with a leading dot
+	suffix string
+	tenant *tenant
+}
+
+// domainMap resolves the domains to the tenants. A domain resolves, in order of
+// precedence, to the tenant listing it, to the tenant listing the longest wildcard
+// matching it, to the tenant named by the first matching rule or to the default
+// tenant.
+type domainMap struct {
+	exact     map[string]*tenant
+	wildcards []wildcard
+	rules     []domainRule
+	fallback  *tenant
+
+	// folded maps the lowercased tenant names to the tenants, for the names
+	// expanded by the rules; nil marks names differing in case only
+	folded map[string]*tenant
+}
+
+// buildDomains maps the domains of the tenants, using the provided configurations,
+// reporting the domains and the defaults claimed by more than one tenant
+func buildDomains(tenants map[string]*tenant, configs map[string]Tenant, rules []domainRule) (*domainMap, error) {
+	m := &domainMap{exact: make(map[string]*tenant), rules: rules, folded: make(map[string]*tenant)}
+	owners := make(map[string]string)
+	fallback := ""
+
+	// sorted for deterministic errors
+	names := make([]string, 0, len(tenants))
+	for name := range tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		t := tenants[name]
+		cfg := configs[name]
+
+		folded := strings.ToLower(name)
+		if _, ok := m.folded[folded]; ok {
+			m.folded[folded] = nil
+		} else {
+			m.folded[folded] = t
+		}
+
+		for _, d := range cfg.Domains {
+			d = normalizeDomain(d)
+			if owner, ok := owners[d]; ok && owner != name {
+				return nil, fmt.Errorf("domain %s is mapped to tenants %s and %s", d, owner, name)
+			}
+			owners[d] = name
+
+			if strings.HasPrefix(d, "*.") {
+				m.wildcards = append(m.wildcards, wildcard{suffix: d[1:], tenant: t})
+			} else if strings.Contains(d, "*") {
+				return nil, fmt.Errorf("tenant %s: invalid domain pattern %s", name, d)
+			} else {
+				m.exact[d] = t
+			}
+		}
+
+		if cfg.Default {
+			if fallback != "" {
+				return nil, fmt.Errorf("tenant %s and %s are both default", fallback, name)
+			}
+			fallback = name
+			m.fallback = t
+		}
+	}
+
+	sort.Slice(m.wildcards, func(i, j int) bool {
+		a, b := m.wildcards[i].suffix, m.wildcards[j].suffix
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+
+	return m, nil
+}
+
+// lookup returns the tenant the domain resolves to, or nil
+func (m *domainMap) lookup(domain string, tenants map[string]*tenant) *tenant {
+	d := normalizeDomain(domain)
+	if t, ok := m.exact[d]; ok {
+		return t
+	}
+
+	for _, w := range m.wildcards {
+		if strings.HasSuffix(d, w.suffix) {
+			return w.tenant
+		}
+	}
+
+	for _, r := range m.rules {
+		match := r.re.FindStringSubmatchIndex(d)
+		if match == nil {
+			continue
+		}
+
+		name := string(r.re.ExpandString(nil, r.tenant, d, match))
+		if t, ok := tenants[name]; ok {
+			return t
+		}
+		if t := m.folded[strings.ToLower(name)]; t != nil {
+			return t
+		}
+	}
+
+	return m.fallback
+}
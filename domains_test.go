@@ -0,0 +1,165 @@
+package goat
+
+import (
+	"strings"
+	"testing"
+)
+
+// newDomainMap maps the domains of the tenants with the rules
+func newDomainMap(t *testing.T, cfgs []Tenant, rules []DomainRule) (*domainMap, map[string]*tenant) {
+	t.Helper()
+
+	compiled, err := compileRules(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenants := make(map[string]*tenant, len(cfgs))
+	configs := make(map[string]Tenant, len(cfgs))
+	for _, cfg := range cfgs {
+		tenants[cfg.Name] = &tenant{config: cfg}
+		configs[cfg.Name] = cfg
+	}
+
+	m, err := buildDomains(tenants, configs, compiled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, tenants
+}
+
+func TestDomainLookup(t *testing.T) {
+	tenants := []Tenant{
+		{Name: "exact", Domains: []string{"www.example.com"}},
+		{Name: "wide", Domains: []string{"*.example.com"}},
+		{Name: "narrow", Domains: []string{"*.eu.example.com"}},
+		{Name: "Acme", Domains: []string{"Acme.Example.ORG."}},
+		{Name: "beta"},
+		{Name: "fallback", Default: true},
+	}
+	rules := []DomainRule{
+		{Pattern: `(?P<tenant>[a-z0-9-]+)\.example\.com`},
+		{Pattern: `([a-z0-9-]+)\.example\.net`},
+		{Pattern: `(beta|gamma)\.example\.net`, Tenant: "exact"},
+		{Pattern: `([a-z0-9-]+)\.example\.io`},
+	}
+
+	tests := []struct {
+		name   string
+		domain string
+		tenant string
+	}{
+		{"exact beats wildcard", "www.example.com", "exact"},
+		{"wildcard", "shop.example.com", "wide"},
+		{"longest wildcard wins", "shop.eu.example.com", "narrow"},
+		{"wildcard beats rule", "beta.example.com", "wide"},
+		{"first matching rule wins", "beta.example.net", "beta"},
+		{"rule expanding to an unknown tenant falls through", "gamma.example.net", "exact"},
+		{"rule ignores the tenant name case", "acme.example.io", "Acme"},
+		{"rule matches the normalized domain", "ACME.Example.IO:443", "Acme"},
+		{"no matching rule falls back to the default", "beta.eu.example.net", "fallback"},
+		{"port is removed", "www.example.com:8443", "exact"},
+		{"case is normalized", "WWW.Example.Com", "exact"},
+		{"trailing dot is removed", "www.example.com.", "exact"},
+		{"configured domain is normalized", "acme.example.org", "Acme"},
+		{"unknown domain falls back to the default", "unknown.org", "fallback"},
+	}
+
+	m, registered := newDomainMap(t, tenants, rules)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := m.lookup(tt.domain, registered)
+			if got == nil {
+				t.Fatalf("%s resolved to no tenant, expected %s", tt.domain, tt.tenant)
+			}
+			if got.config.Name != tt.tenant {
+				t.Fatalf("%s resolved to %s, expected %s", tt.domain, got.config.Name, tt.tenant)
+			}
+		})
+	}
+}
+
+func TestDomainLookupWithoutDefault(t *testing.T) {
+	m, registered := newDomainMap(t, []Tenant{{Name: "acme", Domains: []string{"acme.com"}}}, nil)
+	if got := m.lookup("other.com", registered); got != nil {
+		t.Fatalf("resolved to %s, expected none", got.config.Name)
+	}
+}
+
+func TestDomainRuleAmbiguousCase(t *testing.T) {
+	tenants := []Tenant{{Name: "Acme"}, {Name: "ACME"}, {Name: "fallback", Default: true}}
+	m, registered := newDomainMap(t, tenants, []DomainRule{{Pattern: `([a-z]+)\.example\.com`}})
+	if got := m.lookup("acme.example.com", registered); got.config.Name != "fallback" {
+		t.Fatalf("resolved to %s, expected the default tenant", got.config.Name)
+	}
+}
+
+func TestBuildDomainsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		tenants []Tenant
+		err     string
+	}{
+		{
+			"duplicate domain",
+			[]Tenant{{Name: "a", Domains: []string{"example.com"}}, {Name: "b", Domains: []string{"example.com"}}},
+			"domain example.com is mapped to tenants a and b",
+		},
+		{
+			"duplicate domain after normalization",
+			[]Tenant{{Name: "a", Domains: []string{"Example.com:80"}}, {Name: "b", Domains: []string{"example.com."}}},
+			"domain example.com is mapped to tenants a and b",
+		},
+		{
+			"duplicate wildcard",
+			[]Tenant{{Name: "a", Domains: []string{"*.example.com"}}, {Name: "b", Domains: []string{"*.example.com"}}},
+			"domain *.example.com is mapped to tenants a and b",
+		},
+		{
+			"invalid wildcard",
+			[]Tenant{{Name: "a", Domains: []string{"www.*.example.com"}}},
+			"tenant a: invalid domain pattern www.*.example.com",
+		},
+		{
+			"two defaults",
+			[]Tenant{{Name: "a", Default: true}, {Name: "b", Default: true}},
+			"tenant a and b are both default",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tenants := make(map[string]*tenant, len(tt.tenants))
+			configs := make(map[string]Tenant, len(tt.tenants))
+			for _, cfg := range tt.tenants {
+				tenants[cfg.Name] = &tenant{config: cfg}
+				configs[cfg.Name] = cfg
+			}
+
+			_, err := buildDomains(tenants, configs, nil)
+			if err == nil || err.Error() != tt.err {
+				t.Fatalf("got error %v, expected %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCompileRulesErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule DomainRule
+		err  string
+	}{
+		{"invalid pattern", DomainRule{Pattern: `(`}, "domain rule ("},
+		{"no capture", DomainRule{Pattern: `example\.com`}, "captures no tenant name"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileRules([]DomainRule{tt.rule})
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, expected %s", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package goat
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Order is a sort criterion of a pageable request
+type Order struct {
+	Field string
+	Desc  bool
+}
+
+// Filter is a filter criterion of a pageable request, given as field:op:value
+type Filter struct {
+	Field string
+	Op    string
+	Value string
+}
+
+// filterOps maps the filter operators to the SQL ones
+var filterOps = map[string]string{
+	"eq":   "=",
+	"ne":   "<>",
+	"lt":   "<",
+	"le":   "<=",
+	"gt":   ">",
+	"ge":   ">=",
+	"like": "LIKE",
+	"in":   "IN",
+}
+
+// Columns is the whitelist of the fields clients can sort and filter by, mapped to
+// the SQL columns (or expressions) they correspond to. Columns are trusted and
+// embedded in the statements as they are.
+type Columns map[string]string
+
+// ParseSort parses the sort parameters, each one a comma separated list of fields
+// optionally followed by the direction, e.g. "name,asc" or "createdAt,desc"
+func ParseSort(params []string) []Order {
+	orders := make([]Order, 0)
+	for _, param := range params {
+		fields := strings.Split(param, ",")
+		desc := false
+		switch last := strings.ToLower(strings.TrimSpace(fields[len(fields)-1])); last {
+		case "asc", "desc":
+			desc = last == "desc"
+			fields = fields[:len(fields)-1]
+		}
+
+		for _, f := range fields {
+			if f = strings.TrimSpace(f); f != "" {
+				orders = append(orders, Order{Field: f, Desc: desc})
+			}
+		}
+	}
+	return orders
+}
+
+// ParseFilters parses the filter parameters, each one as field:op:value, e.g.
+// "status:eq:active" or "id:in:1,2,3". The operators are eq, ne, lt, le, gt, ge,
+// like and in
+func ParseFilters(params []string) []Filter {
+	filters := make([]Filter, 0, len(params))
+	for _, param := range params {
+		parts := strings.SplitN(param, ":", 3)
+		f := Filter{Field: parts[0]}
+		if len(parts) > 1 {
+			f.Op = strings.ToLower(parts[1])
+		}
+		if len(parts) > 2 {
+			f.Value = parts[2]
+		}
+		filters = append(filters, f)
+	}
+	return filters
+}
+
+// Validate checks that the request sorts and filters only by the allowed fields,
+// with known operators
+func (p Pageable) Validate(cols Columns) error {
+	for _, o := range p.Sort {
+		if _, ok := cols[o.Field]; !ok {
+			return fmt.Errorf("cannot sort by %s", o.Field)
+		}
+	}
+
+	for _, f := range p.Filters {
+		if _, ok := cols[f.Field]; !ok {
+			return fmt.Errorf("cannot filter by %s", f.Field)
+		}
+
+		if _, ok := filterOps[f.Op]; !ok {
+			return fmt.Errorf("invalid filter operator %s for %s", f.Op, f.Field)
+		}
+	}
+
+	return nil
+}
+
+// OrderBy returns the ORDER BY clause sorting as requested, or an empty string if
+// no sort is requested
+func (p Pageable) OrderBy(cols Columns) (string, error) {
+	if len(p.Sort) == 0 {
+		return "", nil
+	}
+
+	terms := make([]string, 0, len(p.Sort))
+	for _, o := range p.Sort {
+		col, ok := cols[o.Field]
+		if !ok {
+			return "", fmt.Errorf("cannot sort by %s", o.Field)
+		}
+
+		if o.Desc {
+			terms = append(terms, col+" DESC")
+		} else {
+			terms = append(terms, col+" ASC")
+		}
+	}
+
+	return " ORDER BY " + strings.Join(terms, ", "), nil
+}
+
+// Where returns the condition filtering as requested, joined by AND, and the args
+// with the filter values appended. Values are bound to placeholders numbered after
+// the provided args. The condition is empty if no filter is requested.
+func (p Pageable) Where(cols Columns, args []interface{}) (string, []interface{}, error) {
+	conds := make([]string, 0, len(p.Filters))
+	for _, f := range p.Filters {
+		col, ok := cols[f.Field]
+		if !ok {
+			return "", nil, fmt.Errorf("cannot filter by %s", f.Field)
+		}
+
+		op, ok := filterOps[f.Op]
+		if !ok {
+			return "", nil, fmt.Errorf("invalid filter operator %s for %s", f.Op, f.Field)
+		}
+
+		if op != "IN" {
+			args = append(args, f.Value)
+			conds = append(conds, col+" "+op+" $"+strconv.Itoa(len(args)))
+			continue
+		}
+
+		placeholders := make([]string, 0)
+		for _, v := range strings.Split(f.Value, ",") {
+			args = append(args, v)
+			placeholders = append(placeholders, "$"+strconv.Itoa(len(args)))
+		}
+		conds = append(conds, col+" IN ("+strings.Join(placeholders, ", ")+")")
+	}
+
+	return strings.Join(conds, " AND "), args, nil
+}
+
+// Limit returns the LIMIT and OFFSET clause selecting the requested page, and the
+// args with the limit and the offset appended. A negative index or size, which
+// would make the database reject the query, counts as zero.
+func (p Pageable) Limit(args []interface{}) (string, []interface{}) {
+	if p.Index < 0 {
+		p.Index = 0
+	}
+	if p.Size < 0 {
+		p.Size = 0
+	}
+
+	args = append(args, p.Size, p.Offset())
+	return " LIMIT $" + strconv.Itoa(len(args)-1) + " OFFSET $" + strconv.Itoa(len(args)), args
+}
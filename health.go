@@ -0,0 +1,208 @@
+package goat
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TenantStatus reports the health and the connection pool statistics of a tenant
+type TenantStatus struct {
+	Name string `json:"name"`
+
+	// Opened tells whether the tenant database connection is opened
+	Opened bool `json:"opened"`
+
+	Healthy   bool        `json:"healthy"`
+	Error     string      `json:"error,omitempty"`
+	CheckedAt time.Time   `json:"checkedAt"`
+	Stats     sql.DBStats `json:"stats"`
+
+	Replicas []ReplicaStatus `json:"replicas,omitempty"`
+}
+
+// ReplicaStatus reports the health and the connection pool statistics of a read
+// replica. Unhealthy replicas are not used for reading, but do not make the tenant
+// unhealthy
+type ReplicaStatus struct {
+	Healthy bool        `json:"healthy"`
+	Error   string      `json:"error,omitempty"`
+	Stats   sql.DBStats `json:"stats"`
+}
+
+// check pings the tenant database, updating its health state. Tenants whose
+// connection is not opened are checked only if unhealthy, to find out when they
+// recover.
+func (t *tenant) check(ctx context.Context, timeout time.Duration) {
+	t.mu.Lock()
+	th := t.handle
+	failed := t.failure != nil
+	t.mu.Unlock()
+
+	if th == nil {
+		if !failed {
+			return
+		}
+
+		var err error
+		if th, err = t.open(false); err != nil {
+			return
+		}
+	}
+
+	th.replicas.check(ctx, th.Name, timeout)
+
+	pctx, cancel := context.WithTimeout(ctx, timeout)
+	err := th.pool().PingContext(pctx)
+	cancel()
+
+	if ctx.Err() != nil {
+		// the check was interrupted, not failed
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.handle == nil || t.handle.pool() != th.pool() {
+		// the connection was closed or replaced meanwhile, e.g. by the idle
+		// timeout or a reload: the result does not apply to the tenant anymore
+		return
+	}
+
+	if err != nil && t.failure == nil {
+		log.Println("Tenant", th.Name, "is unhealthy:", err)
+	} else if err == nil && t.failure != nil {
+		log.Println("Tenant", th.Name, "is healthy again")
+	}
+
+	t.failure = err
+	t.checked = time.Now()
+}
+
+// status returns the status of the tenant
+func (t *tenant) status() TenantStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := TenantStatus{
+		Name:      t.config.Name,
+		Opened:    t.handle != nil,
+		Healthy:   t.failure == nil,
+		CheckedAt: t.checked,
+	}
+
+	if t.failure != nil {
+		s.Error = t.failure.Error()
+	}
+
+	if t.handle != nil {
+		s.Stats = t.handle.pool().Stats()
+		s.Replicas = t.handle.replicas.status()
+	}
+
+	return s
+}
+
+// all returns all the registered tenants
+func (mdb *MDB) all() []*tenant {
+	mdb.mu.RLock()
+	defer mdb.mu.RUnlock()
+
+	tenants := make([]*tenant, 0, len(mdb.tenants))
+	for _, t := range mdb.tenants {
+		tenants = append(tenants, t)
+	}
+	return tenants
+}
+
+// CheckHealth pings the tenant databases at the provided interval, until the context
+// is canceled. A tenant whose ping fails or does not complete within the timeout is
+// marked unhealthy: while the checker runs, its lookups fail with
+// ErrTenantUnavailable until a later ping succeeds.
+func (mdb *MDB) CheckHealth(ctx context.Context, interval, timeout time.Duration) {
+	atomic.AddInt32(&mdb.checkers, 1)
+	defer atomic.AddInt32(&mdb.checkers, -1)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, t := range mdb.all() {
+			wg.Add(1)
+			go func(t *tenant) {
+				defer wg.Done()
+				t.check(ctx, timeout)
+			}(t)
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Status returns the status of all the tenants, sorted by name
+func (mdb *MDB) Status() []TenantStatus {
+	tenants := mdb.all()
+	status := make([]TenantStatus, 0, len(tenants))
+	for _, t := range tenants {
+		status = append(status, t.status())
+	}
+
+	sort.Slice(status, func(i, j int) bool { return status[i].Name < status[j].Name })
+	return status
+}
+
+// LiveHandler replies 200 OK as long as the MDB is not closed, whatever the health
+// of the tenants
+func (mdb *MDB) LiveHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mdb.mu.RLock()
+		closed := mdb.closed
+		mdb.mu.RUnlock()
+
+		if closed {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write([]byte("ok"))
+	})
+}
+
+// ReadyHandler replies with the status of the tenants, as 200 OK if all of them are
+// healthy or 503 Service Unavailable otherwise
+func (mdb *MDB) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mdb.mu.RLock()
+		closed := mdb.closed
+		mdb.mu.RUnlock()
+
+		status := mdb.Status()
+		code := http.StatusOK
+		if closed {
+			code = http.StatusServiceUnavailable
+		}
+
+		for _, s := range status {
+			if !s.Healthy {
+				code = http.StatusServiceUnavailable
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(status)
+	})
+}
@@ -0,0 +1,289 @@
+// Package migrate applies versioned SQL migrations to the tenant databases of a
+// goat.MDB.
+//
+// Migrations are SQL files named <version>_<description>.sql, e.g.
+// 0001_create_users.sql, usually embedded in the application:
+//
+//	//go:embed migrations/*.sql
+//	var migrations embed.FS
+//
+//	m := migrate.Migrator{FS: migrations, Dir: "migrations"}
+//	results := m.MigrateAll(ctx, mdb, 4)
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lucalattore/goat"
+)
+
+// Migration is a versioned SQL script
+type Migration struct {
+	Version int64
+	Name    string
+	SQL     string
+}
+
+// Migrator applies the migrations found in a file system. Every migration runs in its
+// own transaction holding an advisory lock, so that concurrent migrators of the same
+// tenant apply it only once. Applied versions are recorded in a table of the tenant
+// database, or of the tenant schema if the tenant shares the database.
+type Migrator struct {
+	FS fs.FS
+
+	// Directory of the migrations in the file system, the root if not set
+	Dir string
+
+	// Name of the table recording the applied versions, "schema_migrations" if not set
+	Table string
+
+	// LockID is the key of the advisory lock. If not set, it is derived from the
+	// table name and the tenant schema, so that tenants mapped to different schemas
+	// of a shared database are migrated concurrently
+	LockID int64
+}
+
+// Result is the outcome of the migration of a tenant
+type Result struct {
+	Tenant  string
+	Applied []int64
+	Err     error
+}
+
+func (m *Migrator) tableName() string {
+	if m.Table == "" {
+		return "schema_migrations"
+	}
+
+	return m.Table
+}
+
+func (m *Migrator) lockID(th *goat.TenantHandle) int64 {
+	if m.LockID != 0 {
+		return m.LockID
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte("goat/migrate:" + m.tableName() + ":" + th.Config.Schema))
+	return int64(h.Sum64())
+}
+
+// Load reads the migrations, sorted by version
+func (m *Migrator) Load() ([]Migration, error) {
+	dir := m.Dir
+	if dir == "" {
+		dir = "."
+	}
+
+	entries, err := fs.ReadDir(m.FS, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]Migration, 0, len(entries))
+	versions := make(map[int64]string)
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".sql") {
+			continue
+		}
+
+		name := strings.TrimSuffix(e.Name(), ".sql")
+		i := strings.Index(name, "_")
+		if i < 0 {
+			i = len(name)
+		}
+
+		version, err := strconv.ParseInt(name[:i], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration file name %s", e.Name())
+		}
+
+		if other, ok := versions[version]; ok {
+			return nil, fmt.Errorf("duplicate migration version %d: %s and %s", version, other, e.Name())
+		}
+		versions[version] = e.Name()
+
+		buf, err := fs.ReadFile(m.FS, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, Migration{Version: version, Name: name, SQL: string(buf)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrate applies the pending migrations to the tenant, returning the versions
+// applied. It stops at the first failure, whose migration is rolled back.
+func (m *Migrator) Migrate(ctx context.Context, th *goat.TenantHandle) ([]int64, error) {
+	migrations, err := m.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	return m.migrate(ctx, th, migrations)
+}
+
+func (m *Migrator) migrate(ctx context.Context, th *goat.TenantHandle, migrations []Migration) ([]int64, error) {
+	done, err := m.appliedVersions(ctx, th)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make([]int64, 0)
+	for _, mg := range migrations {
+		if done[mg.Version] {
+			continue
+		}
+
+		ok, err := m.apply(ctx, th, mg)
+		if err != nil {
+			return applied, fmt.Errorf("migration %s: %w", mg.Name, err)
+		}
+
+		if ok {
+			applied = append(applied, mg.Version)
+		}
+	}
+
+	return applied, nil
+}
+
+// lock takes the advisory lock, held until the end of the transaction, and creates
+// the versions table if needed
+func (m *Migrator) lock(ctx context.Context, th *goat.TenantHandle, tx goat.Transaction) error {
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", m.lockID(th)); err != nil {
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+m.tableName()+` (
+	version BIGINT PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`)
+	return err
+}
+
+// appliedVersions returns the versions already applied to the tenant
+func (m *Migrator) appliedVersions(ctx context.Context, th *goat.TenantHandle) (map[int64]bool, error) {
+	done := make(map[int64]bool)
+	err := th.WithTransaction(ctx, nil, func(tx goat.Transaction) error {
+		if err := m.lock(ctx, th, tx); err != nil {
+			return err
+		}
+
+		versions, err := goat.QueryAll[int64](ctx, tx, "SELECT version FROM "+m.tableName())
+		if err != nil {
+			return err
+		}
+
+		for _, v := range versions {
+			done[v] = true
+		}
+		return nil
+	})
+
+	return done, err
+}
+
+// apply runs the migration unless it has been applied in the meantime, reporting
+// whether it was applied
+func (m *Migrator) apply(ctx context.Context, th *goat.TenantHandle, mg Migration) (bool, error) {
+	applied := false
+	err := th.WithTransaction(ctx, nil, func(tx goat.Transaction) error {
+		if err := m.lock(ctx, th, tx); err != nil {
+			return err
+		}
+
+		_, err := goat.QueryOne[int64](ctx, tx, "SELECT version FROM "+m.tableName()+" WHERE version = $1", mg.Version)
+		if err == nil {
+			return nil
+		}
+
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, mg.SQL); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "INSERT INTO "+m.tableName()+" (version, name) VALUES ($1, $2)", mg.Version, mg.Name)
+		if err != nil {
+			return err
+		}
+
+		applied = true
+		return nil
+	})
+
+	return applied && err == nil, err
+}
+
+// MigrateAll applies the pending migrations to all the tenants, migrating up to
+// concurrency tenants at a time (1 if not positive). A failure does not stop the
+// migration of the other tenants: the results, sorted by tenant name, report the
+// outcome of each one.
+func (m *Migrator) MigrateAll(ctx context.Context, mdb *goat.MDB, concurrency int) []Result {
+	names := mdb.Names()
+	results := make([]Result, len(names))
+
+	migrations, err := m.Load()
+	if err != nil {
+		for i, name := range names {
+			results[i] = Result{Tenant: name, Err: err}
+		}
+		return results
+	}
+
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, name string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			r := Result{Tenant: name}
+			th, err := mdb.Tenant(name)
+			if err == nil {
+				r.Applied, err = m.migrate(ctx, th, migrations)
+			}
+			r.Err = err
+			results[i] = r
+		}(i, name)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// Failed returns the results of the tenants whose migration failed
+func Failed(results []Result) []Result {
+	failed := make([]Result, 0)
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
@@ -1,83 +1,738 @@
 package goat
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ErrUnknownTenant is returned when no tenant is mapped to the requested domain
+var ErrUnknownTenant = errors.New("unknown tenant")
+
+// ErrSharedTenant is returned when the raw database connection of a tenant sharing
+// the database with others is requested: statements must be scoped to the tenant
+// through TenantHandle.Conn or TenantHandle.WithTransaction
+var ErrSharedTenant = errors.New("tenant shares the database")
+
+// ErrTenantUnavailable is returned when the tenant database is unhealthy
+var ErrTenantUnavailable = errors.New("tenant unavailable")
+
+// errClosed is returned by the MDB once it is closed
+var errClosed = errors.New("goat: multitenant database is closed")
+
 // Tenant describes a tenant database configuration
 type Tenant struct {
-	URL             string   `yaml:"url,omitempty"`
-	MaxConnections  int      `yaml:"max-connections,omitempty"`
-	IdleConnections int      `yaml:"idle-connections,omitempty"`
-	Domains         []string `yaml:"domains,omitempty"`
+	// Name identifies the tenant. If empty, the first domain is used
+	Name string `yaml:"name,omitempty"`
+
+	// Driver is the name of the database/sql driver, "postgres" if not set, e.g.
+	// "pgx", "mysql" or "sqlite3". The driver package must be imported by the
+	// application. Schemas, tenant ids and migrations require PostgreSQL
+	Driver string `yaml:"driver,omitempty"`
+
+	URL             string `yaml:"url,omitempty"`
+	MaxConnections  int    `yaml:"max-connections,omitempty"`
+	IdleConnections int    `yaml:"idle-connections,omitempty"`
+
+	// Domains mapped to the tenant, matched regardless of case and port. A domain
+	// starting with "*." matches all its subdomains, e.g. "*.acme.example.com"
+	// matches "www.acme.example.com" but not "acme.example.com"
+	Domains []string `yaml:"domains,omitempty"`
+
+	// ConnMaxLifetime and ConnMaxIdleTime limit how long a connection is reused
+	// and kept idle, e.g. "30m"; no limit if not set
+	ConnMaxLifetime time.Duration `yaml:"conn-max-lifetime,omitempty"`
+	ConnMaxIdleTime time.Duration `yaml:"conn-max-idle-time,omitempty"`
+
+	// ConnectTimeout limits the time to establish a new connection, no limit if not set
+	ConnectTimeout time.Duration `yaml:"connect-timeout,omitempty"`
+
+	// StartupSQL are the statements run on every new connection, e.g. to set the
+	// session time zone
+	StartupSQL []string `yaml:"startup-sql,omitempty"`
+
+	// Default makes the tenant the fallback for unknown domains. At most one
+	// tenant can be the default; without one, unknown domains are rejected
+	Default bool `yaml:"default,omitempty"`
+
+	// Schema, when set, maps the tenant to a schema of a database shared with the
+	// other tenants having the same connection settings
+	Schema string `yaml:"schema,omitempty"`
+
+	// TenantID, when set, identifies the rows of the tenant in a database shared
+	// with the other tenants having the same connection settings. It is assigned
+	// to the TenantSetting variable, to be checked by row level security policies
+	TenantID string `yaml:"tenant-id,omitempty"`
+
+	// TenantSetting is the variable holding the TenantID, "app.tenant_id" if not set
+	TenantSetting string `yaml:"tenant-setting,omitempty"`
+
+	// Replicas are the URLs of the read replicas of the tenant database
+	Replicas []string `yaml:"replicas,omitempty"`
+
+	// ReplicaSelection is the policy selecting the replica for reading, RoundRobin
+	// (the default) or LeastConnections
+	ReplicaSelection string `yaml:"replica-selection,omitempty"`
+}
+
+// shared reports whether the tenant shares its database with other tenants
+func (t Tenant) shared() bool {
+	return t.Schema != "" || t.TenantID != ""
+}
+
+// tenantSetting returns the name of the variable holding the tenant id
+func (t Tenant) tenantSetting() string {
+	if t.TenantSetting == "" {
+		return "app.tenant_id"
+	}
+
+	return t.TenantSetting
+}
+
+// connectionKey identifies the connection settings of the tenant
+func (t Tenant) connectionKey() string {
+	return fmt.Sprintf("%q %q %d %d %v %v %v %q %q %q", t.Driver, t.URL, t.MaxConnections, t.IdleConnections,
+		t.ConnMaxLifetime, t.ConnMaxIdleTime, t.ConnectTimeout, t.StartupSQL, t.Replicas, t.ReplicaSelection)
+}
+
+// sameConnection reports whether two configurations open the same connection
+func (t Tenant) sameConnection(o Tenant) bool {
+	return t.connectionKey() == o.connectionKey() && t.shared() == o.shared()
 }
 
 // Multitenant describes the multitenant configuration
 type Multitenant struct {
-	Tenants []Tenant `yaml:"tenants,omitempty"`
+	Tenants []Tenant     `yaml:"tenants,omitempty"`
+	Rules   []DomainRule `yaml:"rules,omitempty"`
 }
 
-// MDB host multitenant database connection and related domain mapping
-type MDB struct {
-	conns   []*sql.DB
-	domains map[string]*sql.DB
+// TenantHandle is an opened tenant
+type TenantHandle struct {
+	// Name of the tenant
+	Name string
+
+	// DB is the database connection of the tenant. It is nil if the tenant shares
+	// the database with others: statements must then run through Conn or
+	// WithTransaction to be scoped to the tenant
+	DB *sql.DB
+
+	// Config is the configuration the tenant was opened with
+	Config Tenant
+
+	db       *sql.DB
+	replicas *replicaSet
 }
 
-// OpenTenants open all tenant database connections
-func OpenTenants(tenants []Tenant) (*MDB, error) {
-	mdb := &MDB{}
-	mdb.conns = make([]*sql.DB, 0, len(tenants))
-	mdb.domains = make(map[string]*sql.DB)
-	for _, t := range tenants {
-		db, err := openSQL(EvaluateEnv(t.URL), t.MaxConnections, t.IdleConnections)
+// newHandle creates the handle of a tenant opened on the database connection,
+// exposing the connection only if the tenant does not share it
+func newHandle(t Tenant, db *sql.DB, replicas *replicaSet) *TenantHandle {
+	th := &TenantHandle{Name: t.Name, Config: t, db: db, replicas: replicas}
+	if !t.shared() {
+		th.DB = db
+	}
+	return th
+}
+
+// pool returns the database connection of the tenant, shared or not
+func (th *TenantHandle) pool() *sql.DB {
+	if th.db != nil {
+		return th.db
+	}
+	return th.DB
+}
+
+// close closes the database connections of the tenant
+func (th *TenantHandle) close() error {
+	err := th.pool().Close()
+	if rerr := th.replicas.close(); rerr != nil && err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// tenant is a registered tenant, whose database connection may be opened on demand
+type tenant struct {
+	mu     sync.Mutex
+	pools  *pools
+	config Tenant
+	handle *TenantHandle
+	used   time.Time
+
+	// failure is the reason the tenant is unhealthy, nil if healthy
+	failure error
+	checked time.Time
+
+	// checkers counts the health checkers running on the MDB of the tenant
+	checkers *int32
+}
+
+// open returns the opened tenant, opening its database connection if needed. If
+// use, the tenant is opened to serve a request: while a health checker is running
+// an unhealthy tenant fails fast, since the checker finds out when it recovers,
+// otherwise opening is retried and clears the failure if it succeeds.
+func (t *tenant) open(use bool) (*TenantHandle, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if use {
+		if t.failure != nil && atomic.LoadInt32(t.checkers) > 0 {
+			return nil, fmt.Errorf("%w: %s: %v", ErrTenantUnavailable, t.config.Name, t.failure)
+		}
+		t.used = time.Now()
+	}
+
+	if t.handle == nil {
+		th, err := t.pools.open(t.config, t.checkers)
+		t.checked = time.Now()
 		if err != nil {
-			return mdb, err
+			t.failure = err
+			return nil, fmt.Errorf("%w: %s: %v", ErrTenantUnavailable, t.config.Name, err)
+		}
+		if t.failure != nil {
+			log.Println("Tenant", th.Name, "is healthy again")
 		}
+		t.failure = nil
+		t.handle = th
+		t.used = time.Now()
+	}
 
-		mdb.conns = append(mdb.conns, db)
-		for _, d := range t.Domains {
-			mdb.domains[d] = db
+	return t.handle, nil
+}
+
+// opened returns the opened tenant, or nil if its connection is not opened
+func (t *tenant) opened() *TenantHandle {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.handle
+}
+
+// reconfigure updates the configuration of the tenant, keeping its connection
+func (t *tenant) reconfigure(cfg Tenant) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.config = cfg
+	if t.handle != nil {
+		t.handle = newHandle(cfg, t.handle.pool(), t.handle.replicas)
+	}
+}
+
+// close closes the database connection of the tenant if it is opened and, when
+// idle is positive, not used for at least that long
+func (t *tenant) close(idle time.Duration) error {
+	t.mu.Lock()
+	th := t.handle
+	if th == nil || (idle > 0 && (time.Since(t.used) < idle || th.pool().Stats().InUse > 0)) {
+		t.mu.Unlock()
+		return nil
+	}
+	t.handle = nil
+	t.mu.Unlock()
+
+	if idle > 0 {
+		log.Println("Closing idle tenant", th.Name)
+	}
+
+	return t.pools.close(th)
+}
+
+// MDB host multitenant database connection and related domain mapping.
+// It is safe for concurrent use.
+type MDB struct {
+	// admin serializes the changes of the tenant set
+	admin sync.Mutex
+
+	mu      sync.RWMutex
+	tenants map[string]*tenant
+	domains *domainMap
+	rules   []DomainRule
+	closed  bool
+
+	// lazy tells connections are opened on first use rather than when the
+	// tenant is added
+	lazy   bool
+	source TenantSource
+	done   chan struct{}
+
+	pools pools
+
+	// checkers counts the running CheckHealth loops
+	checkers int32
+}
+
+// OpenTenants open all tenant database connections. If a tenant cannot be opened,
+// the connections already opened are closed
+func OpenTenants(tenants []Tenant) (*MDB, error) {
+	mdb := &MDB{tenants: make(map[string]*tenant, len(tenants)), domains: &domainMap{}}
+	for i, t := range tenants {
+		t.Name = tenantName(t, i)
+		if err := mdb.AddTenant(t); err != nil {
+			mdb.Close()
+			return nil, err
 		}
 	}
 	return mdb, nil
 }
 
-func openSQL(dburl string, maxconn, maxidle int) (*sql.DB, error) {
-	db, err := sql.Open("postgres", dburl)
-	if err == nil {
-		if maxconn > 0 {
-			db.SetMaxOpenConns(maxconn)
+// OpenSource registers the tenants provided by the source without opening their
+// database connections: each one is opened the first time the tenant is looked up.
+// If idleTimeout is positive, connections not used for that long are closed, to be
+// opened again on the next lookup; it must exceed the duration of the longest
+// request, since a closed connection fails the requests still holding it.
+func OpenSource(ctx context.Context, src TenantSource, idleTimeout time.Duration) (*MDB, error) {
+	mdb := &MDB{tenants: make(map[string]*tenant), domains: &domainMap{}, lazy: true, source: src, done: make(chan struct{})}
+	if err := mdb.Refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	if idleTimeout > 0 {
+		go mdb.closeIdle(idleTimeout)
+	}
+
+	return mdb, nil
+}
+
+// closeIdle periodically closes the connections idle for the provided timeout,
+// until the MDB is closed
+func (mdb *MDB) closeIdle(timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mdb.done:
+			return
+		case <-ticker.C:
 		}
 
-		if maxidle > 0 {
-			db.SetMaxIdleConns(maxidle)
+		for _, t := range mdb.all() {
+			if err := t.close(timeout); err != nil {
+				log.Println(err)
+			}
 		}
+	}
+}
 
-		err = db.Ping()
-		if err != nil {
-			log.Println(err)
+// tenantName returns the name of the i-th tenant
+func tenantName(t Tenant, i int) string {
+	if t.Name != "" {
+		return t.Name
+	}
+
+	if len(t.Domains) > 0 {
+		return t.Domains[0]
+	}
+
+	return "tenant" + strconv.Itoa(i)
+}
+
+// openTenant opens the database connection of the tenant
+func openTenant(t Tenant, checkers *int32) (*TenantHandle, error) {
+	db, err := openSQL(t, EvaluateEnv(t.URL))
+	if err != nil {
+		if db != nil {
+			db.Close()
 		}
+		return nil, err
+	}
+
+	replicas, err := openReplicas(t, checkers)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return newHandle(t, db, replicas), nil
+}
+
+// openSQL opens a database connection with the settings of the tenant
+func openSQL(t Tenant, dburl string) (*sql.DB, error) {
+	driverName := t.Driver
+	if driverName == "" {
+		driverName = "postgres"
+	}
+
+	c, err := newConnector(driverName, dburl, t.ConnectTimeout, t.StartupSQL)
+	if err != nil {
+		return nil, err
+	}
+
+	db := sql.OpenDB(c)
+	if t.MaxConnections > 0 {
+		db.SetMaxOpenConns(t.MaxConnections)
+	}
+
+	if t.IdleConnections > 0 {
+		db.SetMaxIdleConns(t.IdleConnections)
+	}
+
+	if t.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(t.ConnMaxLifetime)
+	}
+
+	if t.ConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(t.ConnMaxIdleTime)
+	}
+
+	err = db.Ping()
+	if err != nil {
+		log.Println(err)
 	}
 	return db, err
 }
 
+// newTenant creates the tenant with the provided configuration
+func (mdb *MDB) newTenant(cfg Tenant) *tenant {
+	return &tenant{config: cfg, pools: &mdb.pools, checkers: &mdb.checkers}
+}
+
+// connect opens the database connection of a new tenant, unless the MDB is lazy
+func (mdb *MDB) connect(t *tenant) error {
+	if mdb.lazy {
+		return nil
+	}
+
+	_, err := t.open(true)
+	return err
+}
+
+// configs returns the configurations of the registered tenants. The lock must be held
+func (mdb *MDB) configs() map[string]Tenant {
+	configs := make(map[string]Tenant, len(mdb.tenants))
+	for name, t := range mdb.tenants {
+		configs[name] = t.config
+	}
+	return configs
+}
+
+// AddTenant opens the tenant database connection and maps its domains. The tenant
+// must have a name not in use yet. If the MDB was opened from a source, the
+// connection is opened on first use instead.
+func (mdb *MDB) AddTenant(t Tenant) error {
+	if t.Name == "" {
+		return errors.New("tenant name is required")
+	}
+
+	mdb.admin.Lock()
+	defer mdb.admin.Unlock()
+
+	nt := mdb.newTenant(t)
+
+	mdb.mu.RLock()
+	_, exists := mdb.tenants[t.Name]
+	tenants := mdb.copyTenants()
+	configs := mdb.configs()
+	rules := mdb.domains.rules
+	mdb.mu.RUnlock()
+
+	if exists {
+		return fmt.Errorf("duplicate tenant %s", t.Name)
+	}
+
+	tenants[t.Name] = nt
+	configs[t.Name] = t
+	domains, err := buildDomains(tenants, configs, rules)
+	if err != nil {
+		return err
+	}
+
+	if err := mdb.connect(nt); err != nil {
+		return err
+	}
+
+	mdb.mu.Lock()
+	mdb.tenants = tenants
+	mdb.domains = domains
+	mdb.mu.Unlock()
+	return nil
+}
+
+// copyTenants returns a copy of the registered tenants. The lock must be held
+func (mdb *MDB) copyTenants() map[string]*tenant {
+	tenants := make(map[string]*tenant, len(mdb.tenants))
+	for name, t := range mdb.tenants {
+		tenants[name] = t
+	}
+	return tenants
+}
+
+// SetRules replaces the domain rules
+func (mdb *MDB) SetRules(rules []DomainRule) error {
+	compiled, err := compileRules(rules)
+	if err != nil {
+		return err
+	}
+
+	mdb.admin.Lock()
+	defer mdb.admin.Unlock()
+
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+
+	domains, err := buildDomains(mdb.tenants, mdb.configs(), compiled)
+	if err != nil {
+		return err
+	}
+
+	mdb.domains = domains
+	mdb.rules = rules
+	return nil
+}
+
+// RemoveTenant unmaps the tenant and closes its database connection. No new query
+// can start on the tenant once it is unmapped, while the ones in flight are waited
+// for before closing.
+func (mdb *MDB) RemoveTenant(name string) error {
+	mdb.admin.Lock()
+	defer mdb.admin.Unlock()
+
+	mdb.mu.Lock()
+	t, ok := mdb.tenants[name]
+	if ok {
+		tenants := mdb.copyTenants()
+		delete(tenants, name)
+		configs := mdb.configs()
+		delete(configs, name)
+
+		// removing a tenant cannot make the mapping ambiguous
+		mdb.domains, _ = buildDomains(tenants, configs, mdb.domains.rules)
+		mdb.tenants = tenants
+	}
+	mdb.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownTenant, name)
+	}
+
+	return t.close(0)
+}
+
+// Reload applies a new configuration: tenants not configured anymore are removed,
+// new ones are added and only the ones whose connection settings changed are
+// reopened. Domain mappings and rules are updated for all tenants.
+func (mdb *MDB) Reload(cfg Multitenant) error {
+	tenants := make(map[string]Tenant, len(cfg.Tenants))
+	for i, t := range cfg.Tenants {
+		t.Name = tenantName(t, i)
+		if _, ok := tenants[t.Name]; ok {
+			return fmt.Errorf("duplicate tenant %s", t.Name)
+		}
+		tenants[t.Name] = t
+	}
+
+	rules, err := compileRules(cfg.Rules)
+	if err != nil {
+		return err
+	}
+
+	mdb.admin.Lock()
+	defer mdb.admin.Unlock()
+
+	mdb.mu.RLock()
+	current := mdb.copyTenants()
+	mdb.mu.RUnlock()
+
+	next := make(map[string]*tenant, len(tenants))
+	for name, cfg := range tenants {
+		if t, ok := current[name]; ok && t.config.sameConnection(cfg) {
+			next[name] = t
+		} else {
+			next[name] = mdb.newTenant(cfg)
+		}
+	}
+
+	domains, err := buildDomains(next, tenants, rules)
+	if err != nil {
+		return err
+	}
+
+	// open the new connections before touching the current ones, so that a
+	// failure leaves the MDB unchanged
+	for name, t := range next {
+		if current[name] == t {
+			continue
+		}
+
+		if err := mdb.connect(t); err != nil {
+			for name, t := range next {
+				if current[name] != t {
+					t.close(0)
+				}
+			}
+			return err
+		}
+	}
+
+	mdb.mu.Lock()
+	for name, t := range next {
+		if current[name] == t {
+			t.reconfigure(tenants[name])
+		}
+	}
+
+	stale := make([]*tenant, 0)
+	for name, t := range mdb.tenants {
+		if next[name] != t {
+			stale = append(stale, t)
+		}
+	}
+
+	mdb.tenants = next
+	mdb.domains = domains
+	mdb.rules = cfg.Rules
+	mdb.mu.Unlock()
+
+	for _, t := range stale {
+		log.Println("Closing tenant", t.config.Name)
+		if cerr := t.close(0); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Refresh reloads the tenants from the source the MDB was opened with, and the
+// domain rules if the source is a RuleSource. Otherwise the current rules are kept.
+func (mdb *MDB) Refresh(ctx context.Context) error {
+	if mdb.source == nil {
+		return errors.New("goat: multitenant database has no tenant source")
+	}
+
+	tenants, err := mdb.source.LoadTenants(ctx)
+	if err != nil {
+		return err
+	}
+
+	mdb.mu.RLock()
+	rules := mdb.rules
+	mdb.mu.RUnlock()
+
+	if rs, ok := mdb.source.(RuleSource); ok {
+		if rules, err = rs.LoadRules(ctx); err != nil {
+			return err
+		}
+	}
+
+	return mdb.Reload(Multitenant{Tenants: tenants, Rules: rules})
+}
+
 // Close terminates any connection stored in the multitenant database structure
 func (mdb *MDB) Close() error {
-	for _, db := range mdb.conns {
-		err := db.Close()
-		if err != nil {
-			return err
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+
+	if !mdb.closed && mdb.done != nil {
+		close(mdb.done)
+	}
+	mdb.closed = true
+
+	var err error
+	for _, t := range mdb.tenants {
+		if cerr := t.close(0); cerr != nil && err == nil {
+			err = cerr
 		}
 	}
-	return nil
+	return err
 }
 
-// Get find and return the db connection for the provider domain
-func (mdb *MDB) Get(domain string) *sql.DB {
-	db, ok := mdb.domains[domain]
+// Lookup find and return the tenant mapped to the provided domain, opening its
+// connection if needed. Domains are matched as described by Tenant.Domains and
+// DomainRule: exact domains take precedence over wildcards, the longest wildcard
+// over the shorter ones, wildcards over rules. Unknown domains resolve to the
+// default tenant if one is configured, otherwise an error wrapping
+// ErrUnknownTenant is returned
+func (mdb *MDB) Lookup(domain string) (*TenantHandle, error) {
+	mdb.mu.RLock()
+	t := mdb.domains.lookup(domain, mdb.tenants)
+	closed := mdb.closed
+	mdb.mu.RUnlock()
+
+	if closed {
+		return nil, errClosed
+	}
+
+	if t == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTenant, domain)
+	}
+
+	return t.open(true)
+}
+
+// Tenant returns the tenant with the provided name, opening its connection if needed
+func (mdb *MDB) Tenant(name string) (*TenantHandle, error) {
+	mdb.mu.RLock()
+	t, ok := mdb.tenants[name]
+	closed := mdb.closed
+	mdb.mu.RUnlock()
+
+	if closed {
+		return nil, errClosed
+	}
+
 	if !ok {
-		db = mdb.domains["default"]
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTenant, name)
+	}
+
+	return t.open(true)
+}
+
+// Get find and return the db connection for the provider domain, or nil if the
+// domain is unknown, its connection cannot be opened or the tenant shares the
+// database with others. Use Lookup to get the error and to scope the statements of
+// a shared tenant
+func (mdb *MDB) Get(domain string) *sql.DB {
+	t, err := mdb.Lookup(domain)
+	if err != nil {
+		return nil
+	}
+	return t.DB
+}
+
+// Names returns the names of all the tenants, sorted, including the ones whose
+// connection is not opened yet
+func (mdb *MDB) Names() []string {
+	mdb.mu.RLock()
+	defer mdb.mu.RUnlock()
+
+	names := make([]string, 0, len(mdb.tenants))
+	for name := range mdb.tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Tenants returns all the opened tenants
+func (mdb *MDB) Tenants() []*TenantHandle {
+	mdb.mu.RLock()
+	defer mdb.mu.RUnlock()
+
+	tenants := make([]*TenantHandle, 0, len(mdb.tenants))
+	for _, t := range mdb.tenants {
+		if th := t.opened(); th != nil {
+			tenants = append(tenants, th)
+		}
+	}
+	return tenants
+}
+
+// DBs returns the database connections of all the opened tenants, except the ones
+// sharing the database with others (see Tenants)
+func (mdb *MDB) DBs() []*sql.DB {
+	tenants := mdb.Tenants()
+	dbs := make([]*sql.DB, 0, len(tenants))
+	for _, t := range tenants {
+		if t.DB != nil {
+			dbs = append(dbs, t.DB)
+		}
 	}
-	return db
+	return dbs
 }
@@ -0,0 +1,266 @@
+package goat
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyDriver is a database driver whose connections fail while down is set, or
+// while their database name is stored in failing. Pings of the connections to the
+// "slow" database take the channel sent to hold, if any, and wait until it is
+// closed.
+type flakyDriver struct {
+	down    int32
+	failing sync.Map
+	hold    chan chan struct{}
+}
+
+func (d *flakyDriver) Open(name string) (driver.Conn, error) {
+	if _, failing := d.failing.Load(name); failing || atomic.LoadInt32(&d.down) != 0 {
+		return nil, errors.New("connection refused")
+	}
+	return flakyConn{name: name}, nil
+}
+
+type flakyConn struct {
+	name string
+}
+
+func (c flakyConn) Ping(ctx context.Context) error {
+	if _, failing := flaky.failing.Load(c.name); failing {
+		return errors.New("connection reset")
+	}
+
+	if c.name != "slow" {
+		return nil
+	}
+
+	select {
+	case release := <-flaky.hold:
+		<-release
+	default:
+	}
+	return nil
+}
+
+func (flakyConn) Prepare(query string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (flakyConn) Close() error                              { return nil }
+func (flakyConn) Begin() (driver.Tx, error)                 { return flakyTx{}, nil }
+
+type flakyTx struct{}
+
+func (flakyTx) Commit() error   { return nil }
+func (flakyTx) Rollback() error { return nil }
+
+var flaky = &flakyDriver{hold: make(chan chan struct{}, 1)}
+
+func init() {
+	sql.Register("goat-flaky", flaky)
+}
+
+func TestLookupRetriesFailedOpen(t *testing.T) {
+	atomic.StoreInt32(&flaky.down, 1)
+	defer atomic.StoreInt32(&flaky.down, 0)
+
+	src := Multitenant{Tenants: []Tenant{{Name: "acme", Driver: "goat-flaky", URL: "acme", Domains: []string{"acme.com"}}}}
+	mdb, err := OpenSource(context.Background(), src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mdb.Close()
+
+	if _, err := mdb.Lookup("acme.com"); !errors.Is(err, ErrTenantUnavailable) {
+		t.Fatalf("expected ErrTenantUnavailable, got %v", err)
+	}
+
+	atomic.StoreInt32(&flaky.down, 0)
+	th, err := mdb.Lookup("acme.com")
+	if err != nil {
+		t.Fatalf("open not retried: %v", err)
+	}
+	if th.Name != "acme" {
+		t.Fatalf("unexpected tenant %s", th.Name)
+	}
+
+	if s := mdb.Status(); !s[0].Healthy || !s[0].Opened {
+		t.Fatalf("failure not cleared: %+v", s[0])
+	}
+}
+
+func TestLookupFailsFastWhileChecked(t *testing.T) {
+	atomic.StoreInt32(&flaky.down, 1)
+	defer atomic.StoreInt32(&flaky.down, 0)
+
+	src := Multitenant{Tenants: []Tenant{{Name: "acme", Driver: "goat-flaky", URL: "acme", Domains: []string{"acme.com"}}}}
+	mdb, err := OpenSource(context.Background(), src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mdb.Close()
+
+	if _, err := mdb.Lookup("acme.com"); !errors.Is(err, ErrTenantUnavailable) {
+		t.Fatalf("expected ErrTenantUnavailable, got %v", err)
+	}
+
+	failedAt := mdb.Status()[0].CheckedAt
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		mdb.CheckHealth(ctx, time.Hour, time.Second)
+	}()
+
+	// the checker owns the health state: the tenant keeps failing fast until it
+	// is checked again, even if it could be opened
+	for !mdb.Status()[0].CheckedAt.After(failedAt) {
+		time.Sleep(time.Millisecond)
+	}
+	atomic.StoreInt32(&flaky.down, 0)
+	if _, err := mdb.Lookup("acme.com"); !errors.Is(err, ErrTenantUnavailable) {
+		t.Fatalf("expected ErrTenantUnavailable, got %v", err)
+	}
+
+	cancel()
+	wg.Wait()
+
+	if _, err := mdb.Lookup("acme.com"); err != nil {
+		t.Fatalf("open not retried once the checker stopped: %v", err)
+	}
+}
+
+func TestCheckHealthDuringIdleClose(t *testing.T) {
+	src := Multitenant{Tenants: []Tenant{{Name: "acme", Driver: "goat-flaky", URL: "acme", Replicas: []string{"slow"},
+		Domains: []string{"acme.com"}}}}
+	mdb, err := OpenSource(context.Background(), src, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mdb.Close()
+
+	if _, err := mdb.Lookup("acme.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the check pauses while pinging the replica, before the primary
+	release := make(chan struct{})
+	flaky.hold <- release
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		mdb.CheckHealth(ctx, time.Hour, time.Second)
+	}()
+
+	// meanwhile the idle timeout closes the tenant
+	for len(flaky.hold) > 0 || len(mdb.Tenants()) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	// the primary ping of the closed connection must not mark the tenant
+	// unhealthy: checking it would be failing fast and reopening it
+	deadline := time.Now().Add(200 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		if s := mdb.Status()[0]; !s.Healthy {
+			t.Fatalf("closed tenant marked unhealthy: %s", s.Error)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := mdb.Lookup("acme.com"); err != nil {
+		t.Fatalf("idle tenant not reopened on demand: %v", err)
+	}
+}
+
+func TestReplicaHealthWithoutChecker(t *testing.T) {
+	recheck := replicaRecheck
+	replicaRecheck = 10 * time.Millisecond
+	defer func() { replicaRecheck = recheck }()
+
+	flaky.failing.Store("replica", true)
+	defer flaky.failing.Delete("replica")
+
+	src := Multitenant{Tenants: []Tenant{{Name: "acme", Driver: "goat-flaky", URL: "acme", Replicas: []string{"replica"},
+		Domains: []string{"acme.com"}}}}
+	mdb, err := OpenSource(context.Background(), src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mdb.Close()
+
+	th, err := mdb.Lookup("acme.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// waitReader waits until the reader is a replica or, if not, the primary
+	waitReader := func(replica bool) {
+		t.Helper()
+
+		deadline := time.Now().Add(time.Second)
+		for (th.Reader() != th.Writer()) != replica {
+			if time.Now().After(deadline) {
+				t.Fatalf("reading from a replica: %v, expected %v", !replica, replica)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// the replica that failed to open is tried again once it recovers, and left
+	// out again when it goes down
+	waitReader(false)
+	flaky.failing.Delete("replica")
+	waitReader(true)
+	flaky.failing.Store("replica", true)
+	waitReader(false)
+}
+
+func TestRefreshLoadsRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tenants.yaml")
+	yaml := `tenants:
+  - name: acme
+    driver: goat-flaky
+    url: acme
+rules:
+  - pattern: '([a-z]+)\.example\.com'
+`
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	sources := []TenantSource{
+		FileSource(path),
+		Multitenant{
+			Tenants: []Tenant{{Name: "acme", Driver: "goat-flaky", URL: "acme"}},
+			Rules:   []DomainRule{{Pattern: `([a-z]+)\.example\.com`}},
+		},
+	}
+
+	for _, src := range sources {
+		mdb, err := OpenSource(context.Background(), src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		th, err := mdb.Lookup("acme.example.com")
+		mdb.Close()
+		if err != nil {
+			t.Fatalf("%T: rules not loaded: %v", src, err)
+		}
+		if th.Name != "acme" {
+			t.Fatalf("%T: resolved to %s", src, th.Name)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package goat
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Outbox stores events to be published in the database, within the transaction that
+// produces them, so that they are delivered only if the transaction commits. A relay
+// (see rws.OutboxRelay) reads the pending events and publishes them.
+type Outbox struct {
+	// Name of the outbox table, "outbox" if not set
+	Table string
+
+	// Notify, when set, is the channel notified with pg_notify on every event,
+	// so that relays listening on it are woken up as soon as the event is committed
+	Notify string
+}
+
+// TableName returns the name of the outbox table
+func (o Outbox) TableName() string {
+	if o.Table == "" {
+		return "outbox"
+	}
+
+	return o.Table
+}
+
+// Schema returns the statements creating the outbox table
+func (o Outbox) Schema() string {
+	t := o.TableName()
+	return "CREATE TABLE IF NOT EXISTS " + t + ` (
+	id BIGSERIAL PRIMARY KEY,
+	channel TEXT NOT NULL,
+	payload TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	delivered_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS ` + t + `_pending_idx ON ` + t + ` (id) WHERE delivered_at IS NULL;
+`
+}
+
+// Publish stores an event for the channel in the transaction. The payload is stored
+// as it is if it is a string or a []byte, otherwise it is encoded as JSON.
+func (o Outbox) Publish(ctx context.Context, tx Transaction, channel string, payload interface{}) error {
+	var data string
+	switch p := payload.(type) {
+	case string:
+		data = p
+	case []byte:
+		data = string(p)
+	default:
+		buf, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		data = string(buf)
+	}
+
+	_, err := tx.ExecContext(ctx, "INSERT INTO "+o.TableName()+" (channel, payload) VALUES ($1, $2)", channel, data)
+	if err != nil {
+		return err
+	}
+
+	if o.Notify != "" {
+		_, err = tx.ExecContext(ctx, "SELECT pg_notify($1, '')", o.Notify)
+	}
+
+	return err
+}
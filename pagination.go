@@ -7,34 +7,90 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// defaultPageSize is the page size used when the request has none or an invalid one
+const defaultPageSize = 50
+
 // Pageable defines a request for a page of data
 type Pageable struct {
 	Index int `json:"index"`
 	Size  int `json:"size"`
+
+	// Sort and Filters are the criteria requested by the client, to be validated
+	// against the allowed fields (see Columns)
+	Sort    []Order  `json:"-"`
+	Filters []Filter `json:"-"`
 }
 
-// Page defines a page of data
-type Page struct {
+// Offset returns the number of elements preceding the requested page
+func (p Pageable) Offset() int {
+	return p.Index * p.Size
+}
+
+// PageOf defines a page of data of type T
+type PageOf[T any] struct {
 	Pageable
-	TotalElements int   `json:"totalElements"`
-	TotalPages    int   `json:"totalPages"`
-	Content       []any `json:"content"`
+	TotalElements int `json:"totalElements"`
+	TotalPages    int `json:"totalPages"`
+	Content       []T `json:"content"`
 }
 
+// Page defines a page of data
+type Page = PageOf[any]
+
 func NewPage() Page {
 	p := Page{}
 	p.Content = make([]any, 0)
 	return p
 }
 
+// NewPageOf creates the page holding the content requested by the pageable, out of
+// total elements
+func NewPageOf[T any](p Pageable, content []T, total int) PageOf[T] {
+	if content == nil {
+		content = make([]T, 0)
+	}
+
+	page := PageOf[T]{Pageable: p, TotalElements: total, Content: content}
+	page.Compute()
+	return page
+}
+
+// MapPage converts the content of the page with the provided function
+func MapPage[T, U any](p PageOf[T], fn func(T) U) PageOf[U] {
+	content := make([]U, 0, len(p.Content))
+	for _, v := range p.Content {
+		content = append(content, fn(v))
+	}
+
+	return PageOf[U]{
+		Pageable:      p.Pageable,
+		TotalElements: p.TotalElements,
+		TotalPages:    p.TotalPages,
+		Content:       content,
+	}
+}
+
+// GetPageable reads the pageable from the query parameters. A negative page index
+// is replaced by the first page, and a size that is missing, invalid or not
+// positive by the default one
 func GetPageable(c *gin.Context) Pageable {
 	p := Pageable{}
 	p.Index, _ = strconv.Atoi(c.DefaultQuery("page", "0"))
-	p.Size, _ = strconv.Atoi(c.DefaultQuery("size", "50"))
+	if p.Index < 0 {
+		p.Index = 0
+	}
+
+	p.Size, _ = strconv.Atoi(c.DefaultQuery("size", strconv.Itoa(defaultPageSize)))
+	if p.Size <= 0 {
+		p.Size = defaultPageSize
+	}
+
+	p.Sort = ParseSort(c.QueryArray("sort"))
+	p.Filters = ParseFilters(c.QueryArray("filter"))
 	return p
 }
 
-func (p *Page) Compute() {
+func (p *PageOf[T]) Compute() {
 	if p.Size == 0 {
 		p.TotalPages = 0
 	} else {
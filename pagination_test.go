@@ -0,0 +1,46 @@
+package goat
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestGetPageable(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		index int
+		size  int
+	}{
+		{"defaults", "", 0, 50},
+		{"requested page", "?page=2&size=10", 2, 10},
+		{"negative page", "?page=-1&size=10", 0, 10},
+		{"negative size", "?page=1&size=-5", 1, 50},
+		{"zero size", "?size=0", 0, 50},
+		{"invalid size", "?size=ten", 0, 50},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/items"+tt.query, nil)
+
+			p := GetPageable(c)
+			if p.Index != tt.index || p.Size != tt.size {
+				t.Fatalf("got page %d of size %d, expected %d of size %d", p.Index, p.Size, tt.index, tt.size)
+			}
+		})
+	}
+}
+
+func TestLimitClampsNegativeValues(t *testing.T) {
+	clause, args := Pageable{Index: -2, Size: -5}.Limit([]interface{}{"x"})
+	if clause != " LIMIT $2 OFFSET $3" {
+		t.Fatalf("unexpected clause %q", clause)
+	}
+	if args[1] != 0 || args[2] != 0 {
+		t.Fatalf("got limit %v and offset %v, expected 0", args[1], args[2])
+	}
+}
@@ -0,0 +1,166 @@
+package goat
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Querier is implemented by *sql.DB, *sql.Conn and Transaction
+type Querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// fieldIndexes caches the mapping between column names and struct fields per type
+var fieldIndexes sync.Map
+
+var (
+	scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+	timeType    = reflect.TypeOf(time.Time{})
+)
+
+// QueryOne runs the query and scans the first row into a T. If T is a struct
+// columns are mapped to fields by their `db` tag, or by the case-insensitive field
+// name if the tag is missing; otherwise the query must return a single column.
+// sql.ErrNoRows is returned if the query returns no rows.
+func QueryOne[T any](ctx context.Context, q Querier, query string, args ...interface{}) (T, error) {
+	var result T
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return result, err
+		}
+		return result, sql.ErrNoRows
+	}
+
+	if err := scanRow(rows, &result); err != nil {
+		return result, err
+	}
+
+	return result, rows.Close()
+}
+
+// QueryAll runs the query and scans all rows into a slice of T, mapping columns as
+// QueryOne does. An empty slice is returned if the query returns no rows.
+func QueryAll[T any](ctx context.Context, q Querier, query string, args ...interface{}) ([]T, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]T, 0)
+	for rows.Next() {
+		var result T
+		if err := scanRow(rows, &result); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	return results, rows.Err()
+}
+
+// scanRow scans the current row into dest, a pointer to a struct or to a single value
+func scanRow(rows *sql.Rows, dest interface{}) error {
+	v := reflect.ValueOf(dest).Elem()
+	t := v.Type()
+	if t.Kind() != reflect.Struct || t == timeType || reflect.PtrTo(t).Implements(scannerType) {
+		return rows.Scan(dest)
+	}
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	indexes := structFields(t)
+	targets := make([]interface{}, len(columns))
+	for i, column := range columns {
+		index, ok := indexes[strings.ToLower(column)]
+		if !ok {
+			return errors.New("goat: missing destination for column " + column + " in " + t.String())
+		}
+
+		targets[i] = fieldByIndex(v, index).Addr().Interface()
+	}
+
+	return rows.Scan(targets...)
+}
+
+// structFields maps the lowercased column names to the indexes of the struct fields,
+// including the ones of embedded structs. As in encoding/json, a field shadows the
+// fields with the same name nested deeper; among fields at the same depth the first
+// one wins.
+func structFields(t reflect.Type) map[string][]int {
+	if cached, ok := fieldIndexes.Load(t); ok {
+		return cached.(map[string][]int)
+	}
+
+	indexes := make(map[string][]int)
+	var walk func(t reflect.Type, prefix []int)
+	walk = func(t reflect.Type, prefix []int) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			index := append(append([]int{}, prefix...), i)
+			tag := f.Tag.Get("db")
+			if tag == "-" {
+				continue
+			}
+
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+
+			if f.Anonymous && tag == "" && ft.Kind() == reflect.Struct {
+				// pointers to unexported structs cannot be allocated
+				if f.IsExported() || f.Type.Kind() != reflect.Ptr {
+					walk(ft, index)
+				}
+				continue
+			}
+
+			if !f.IsExported() {
+				continue
+			}
+
+			name := strings.ToLower(f.Name)
+			if tag != "" {
+				name = strings.ToLower(strings.Split(tag, ",")[0])
+			}
+
+			if cur, ok := indexes[name]; !ok || len(index) < len(cur) {
+				indexes[name] = index
+			}
+		}
+	}
+	walk(t, nil)
+
+	fieldIndexes.Store(t, indexes)
+	return indexes
+}
+
+// fieldByIndex returns the nested field, allocating embedded struct pointers as needed
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+
+	return v
+}
@@ -0,0 +1,88 @@
+package goat
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// LoadMultitenant reads the multitenant configuration from a YAML file
+func LoadMultitenant(path string) (Multitenant, error) {
+	var cfg Multitenant
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+
+	err = yaml.Unmarshal(buf, &cfg)
+	return cfg, err
+}
+
+// WatchFile reloads the tenants from the YAML file every time it is modified,
+// checking it at the provided interval, until the context is canceled
+func (mdb *MDB) WatchFile(ctx context.Context, path string, interval time.Duration) {
+	var modTime time.Time
+	if fi, err := os.Stat(path); err == nil {
+		modTime = fi.ModTime()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			log.Println("Cannot watch tenant configuration:", err)
+			continue
+		}
+
+		if fi.ModTime().Equal(modTime) {
+			continue
+		}
+
+		modTime = fi.ModTime()
+		mdb.reloadFile(path)
+	}
+}
+
+// ReloadOnSignal reloads the tenants from the YAML file every time the process
+// receives SIGHUP, until the context is canceled
+func (mdb *MDB) ReloadOnSignal(ctx context.Context, path string) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+			mdb.reloadFile(path)
+		}
+	}
+}
+
+// reloadFile reloads the tenants from the YAML file, logging any failure
+func (mdb *MDB) reloadFile(path string) {
+	log.Println("Reloading tenant configuration from", path)
+	cfg, err := LoadMultitenant(path)
+	if err == nil {
+		err = mdb.Reload(cfg)
+	}
+
+	if err != nil {
+		log.Println("Cannot reload tenant configuration:", err)
+	}
+}
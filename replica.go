@@ -0,0 +1,281 @@
+package goat
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Replica selection policies
+const (
+	// RoundRobin selects the healthy replicas in turn
+	RoundRobin = "round-robin"
+
+	// LeastConnections selects the healthy replica with the fewest connections in use
+	LeastConnections = "least-connections"
+)
+
+// replicaRecheck is how often a replica in use is pinged when no health checker
+// is running
+var replicaRecheck = 5 * time.Second
+
+// replicaTimeout limits the pings of the replicas in use when no health checker is
+// running, if the tenant has no connect timeout
+const replicaTimeout = 5 * time.Second
+
+// replica is a read replica of a tenant database
+type replica struct {
+	db *sql.DB
+
+	mu sync.Mutex
+	// failure is the reason the replica is unhealthy, nil if healthy
+	failure error
+	// checked is when the replica was last pinged, and checking tells a ping
+	// started in the background is in progress
+	checked  time.Time
+	checking bool
+}
+
+// replicaSet holds the read replicas of a tenant
+type replicaSet struct {
+	name     string
+	policy   string
+	timeout  time.Duration
+	next     uint64
+	replicas []*replica
+
+	// checkers counts the health checkers running on the MDB of the tenant
+	checkers *int32
+}
+
+// openReplicas opens the read replicas of the tenant. A replica that cannot be
+// reached is opened anyway and marked unhealthy until a ping succeeds: the ones of
+// the health checker, if running, or otherwise the ones started when it is selected.
+func openReplicas(t Tenant, checkers *int32) (*replicaSet, error) {
+	policy := t.ReplicaSelection
+	if policy == "" {
+		policy = RoundRobin
+	}
+
+	if policy != RoundRobin && policy != LeastConnections {
+		return nil, fmt.Errorf("tenant %s: unknown replica selection %s", t.Name, policy)
+	}
+
+	timeout := t.ConnectTimeout
+	if timeout <= 0 {
+		timeout = replicaTimeout
+	}
+
+	rs := &replicaSet{name: t.Name, policy: policy, timeout: timeout, checkers: checkers}
+	for _, url := range t.Replicas {
+		db, err := openSQL(t, EvaluateEnv(url))
+		if db == nil {
+			rs.close()
+			return nil, err
+		}
+
+		rs.replicas = append(rs.replicas, &replica{db: db, failure: err, checked: time.Now()})
+	}
+
+	return rs, nil
+}
+
+// pick selects a healthy replica, or returns nil if there are none
+func (rs *replicaSet) pick() *sql.DB {
+	if rs == nil || len(rs.replicas) == 0 {
+		return nil
+	}
+
+	if rs.policy == LeastConnections {
+		var best *sql.DB
+		inUse := 0
+		for i, r := range rs.replicas {
+			if !rs.available(i) {
+				continue
+			}
+
+			if n := r.db.Stats().InUse; best == nil || n < inUse {
+				best, inUse = r.db, n
+			}
+		}
+		return best
+	}
+
+	n := uint64(len(rs.replicas))
+	start := atomic.AddUint64(&rs.next, 1)
+	for i := uint64(0); i < n; i++ {
+		if i := int((start + i) % n); rs.available(i) {
+			return rs.replicas[i].db
+		}
+	}
+	return nil
+}
+
+// available tells whether the replica is healthy. Unless a health checker is
+// running, a replica not pinged for replicaRecheck is pinged in the background,
+// so that a replica going down is left out and a failed one is tried again.
+func (rs *replicaSet) available(i int) bool {
+	r := rs.replicas[i]
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if atomic.LoadInt32(rs.checkers) == 0 && !r.checking && time.Since(r.checked) >= replicaRecheck {
+		r.checking = true
+		go rs.ping(context.Background(), i, rs.name, rs.timeout)
+	}
+
+	return r.failure == nil
+}
+
+// check pings the replicas, updating their health state
+func (rs *replicaSet) check(ctx context.Context, name string, timeout time.Duration) {
+	if rs == nil {
+		return
+	}
+
+	for i := range rs.replicas {
+		if !rs.ping(ctx, i, name, timeout) {
+			return
+		}
+	}
+}
+
+// ping pings the replica, updating its health state. It returns false if the ping
+// was interrupted by the context.
+func (rs *replicaSet) ping(ctx context.Context, i int, name string, timeout time.Duration) bool {
+	r := rs.replicas[i]
+	pctx, cancel := context.WithTimeout(ctx, timeout)
+	err := r.db.PingContext(pctx)
+	cancel()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.checking = false
+	if ctx.Err() != nil {
+		return false
+	}
+
+	if err != nil && r.failure == nil {
+		log.Println("Replica", i, "of tenant", name, "is unhealthy:", err)
+	} else if err == nil && r.failure != nil {
+		log.Println("Replica", i, "of tenant", name, "is healthy again")
+	}
+	r.failure = err
+	r.checked = time.Now()
+	return true
+}
+
+// status returns the status of the replicas
+func (rs *replicaSet) status() []ReplicaStatus {
+	if rs == nil {
+		return nil
+	}
+
+	status := make([]ReplicaStatus, 0, len(rs.replicas))
+	for _, r := range rs.replicas {
+		r.mu.Lock()
+		s := ReplicaStatus{Healthy: r.failure == nil, Stats: r.db.Stats()}
+		if r.failure != nil {
+			s.Error = r.failure.Error()
+		}
+		r.mu.Unlock()
+
+		status = append(status, s)
+	}
+	return status
+}
+
+func (rs *replicaSet) close() error {
+	if rs == nil {
+		return nil
+	}
+
+	var err error
+	for _, r := range rs.replicas {
+		if cerr := r.db.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Writer returns the primary database connection of the tenant, or nil if the
+// tenant shares the database with others
+func (th *TenantHandle) Writer() *sql.DB {
+	return th.DB
+}
+
+// Reader returns the database connection of a healthy read replica of the tenant,
+// selected according to the tenant policy, or the primary one if there are none.
+// The replica health is kept by CheckHealth if running, otherwise by pinging the
+// replicas in use every few seconds in the background: a replica going down may
+// still be returned until then.
+// It returns nil if the tenant shares the database with others: use
+// WithReadOnlyTransaction instead.
+func (th *TenantHandle) Reader() *sql.DB {
+	if th.Config.shared() {
+		return nil
+	}
+
+	return th.reader()
+}
+
+// reader returns the database connection of a healthy read replica of the tenant,
+// or the primary one if there are none
+func (th *TenantHandle) reader() *sql.DB {
+	if db := th.replicas.pick(); db != nil {
+		return db
+	}
+
+	return th.pool()
+}
+
+// WithReadOnlyTransaction runs the `TxFn` in a read-only transaction on a read
+// replica of the tenant (see Reader), scoped to the tenant as WithTransaction does
+func (th *TenantHandle) WithReadOnlyTransaction(ctx context.Context, fn TxFn) error {
+	opts := &sql.TxOptions{ReadOnly: true}
+	db := th.reader()
+	if !th.Config.shared() {
+		return WithTransactionContext(ctx, db, opts, fn)
+	}
+
+	return withTenantTransaction(ctx, db, th.Name, func(ctx context.Context, tx *sql.Tx) error {
+		return th.scope(ctx, tx, true)
+	}, opts, fn)
+}
+
+// Writer returns the primary database connection of the tenant mapped to the domain.
+// It returns ErrSharedTenant if the tenant shares the database with others.
+func (mdb *MDB) Writer(domain string) (*sql.DB, error) {
+	th, err := mdb.Lookup(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	if th.Config.shared() {
+		return nil, ErrSharedTenant
+	}
+
+	return th.Writer(), nil
+}
+
+// Reader returns a read replica connection of the tenant mapped to the domain, or
+// its primary one if it has no healthy replicas. It returns ErrSharedTenant if the
+// tenant shares the database with others.
+func (mdb *MDB) Reader(domain string) (*sql.DB, error) {
+	th, err := mdb.Lookup(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	if th.Config.shared() {
+		return nil, ErrSharedTenant
+	}
+
+	return th.Reader(), nil
+}
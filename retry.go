@@ -0,0 +1,122 @@
+package goat
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// SQLSTATE codes of the failures that are solved by retrying the transaction
+const (
+	SerializationFailure = "40001"
+	DeadlockDetected     = "40P01"
+)
+
+// RetryPolicy describes how a transaction failed for a transient conflict is retried
+type RetryPolicy struct {
+	// Maximum number of attempts, 5 if not set
+	MaxAttempts int
+
+	// Delay before the first retry, doubled at each attempt, 10ms if not set
+	BaseDelay time.Duration
+
+	// Upper bound of the delay between attempts, 1s if not set
+	MaxDelay time.Duration
+
+	// Retryable classifies the errors worth a retry, IsRetryable if not set
+	Retryable func(error) bool
+
+	// OnAttempt, when set, is called after each attempt with its number
+	// (starting from 1) and its outcome
+	OnAttempt func(attempt int, err error)
+}
+
+// IsRetryable reports whether the error is a serialization failure or a deadlock
+// reported by Postgres. Both lib/pq and pgx errors are recognized.
+func IsRetryable(err error) bool {
+	switch SQLState(err) {
+	case SerializationFailure, DeadlockDetected:
+		return true
+	}
+
+	return false
+}
+
+// SQLState returns the SQLSTATE code of the error, or an empty string if the
+// error does not come from the database driver
+func SQLState(err error) string {
+	// pgx *pgconn.PgError, lib/pq *pq.Error since v1.10
+	var state interface{ SQLState() string }
+	if errors.As(err, &state) {
+		return state.SQLState()
+	}
+
+	// older lib/pq *pq.Error
+	var fields interface{ Get(k byte) string }
+	if errors.As(err, &fields) {
+		return fields.Get('C')
+	}
+
+	return ""
+}
+
+// WithTransactionRetry runs the `TxFn` in a new transaction as WithTransactionContext
+// does, retrying the whole transaction with exponential backoff and jitter as long as
+// it fails for a retryable error. The `TxFn` may be called several times and must not
+// have side effects outside the transaction.
+//
+// When the context carries a transaction against the same database the `TxFn` runs
+// once in a savepoint: a conflict aborts the enclosing transaction, which is the one
+// to be retried.
+func WithTransactionRetry(ctx context.Context, db *sql.DB, opts *sql.TxOptions, policy RetryPolicy, fn TxFn) error {
+	if tx := ambient(ctx, db, ""); tx != nil {
+		return WithNestedTransaction(ctx, tx, fn)
+	}
+
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 5
+	}
+
+	delay := policy.BaseDelay
+	if delay <= 0 {
+		delay = 10 * time.Millisecond
+	}
+
+	maxDelay := policy.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = time.Second
+	}
+
+	retryable := policy.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := WithTransactionContext(ctx, db, opts, fn)
+		if policy.OnAttempt != nil {
+			policy.OnAttempt(attempt, err)
+		}
+
+		if err == nil || attempt >= maxAttempts || !retryable(err) {
+			return err
+		}
+
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+
+		timer := time.NewTimer(time.Duration(rand.Int63n(int64(delay) + 1)))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+
+		delay *= 2
+	}
+}
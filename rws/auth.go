@@ -0,0 +1,125 @@
+package rws
+
+import (
+	"log"
+	"time"
+)
+
+// reauthenticate handles the "auth" request sent by the client to replace
+// the token used to authenticate the connection before it expires
+func (c *Client) reauthenticate(r *map[string]interface{}) interface{} {
+	token, ok := (*r)["token"].(string)
+	if !ok || token == "" {
+		return NewError("400", "Missing token")
+	}
+
+	authData, err := c.auth.Authenticate(token)
+	if err != nil {
+		log.Println("Client", c.ID, "re-authentication failed:", err)
+		return NewError("403", "Forbidden")
+	}
+
+	exp := authData.ExpiresAt()
+	if !exp.IsZero() && !exp.After(time.Now()) {
+		return NewError("403", "Token expired")
+	}
+
+	// the token can only be renewed by the subject the connection is
+	// authenticated as, so a connection without one cannot take any identity
+	c.authMu.RLock()
+	sub, expiring := c.AuthData.Subject(), !c.AuthData.ExpiresAt().IsZero()
+	c.authMu.RUnlock()
+	if sub == "" || sub != authData.Subject() {
+		log.Println("Client", c.ID, "re-authentication as a different subject", authData.Subject())
+		return NewError("403", "Forbidden")
+	}
+
+	// a token that never expires would disable the expiration of the connection
+	if expiring && exp.IsZero() {
+		log.Println("Client", c.ID, "re-authentication with a token without expiration")
+		return NewError("403", "Token without expiration")
+	}
+
+	log.Println("Client", c.ID, "re-authenticated as user", authData.PreferredUsername())
+	c.authMu.Lock()
+	c.AuthData = authData
+	c.authMu.Unlock()
+	c.setExpiry(exp)
+
+	reply := NewReply("auth", "")
+	if !exp.IsZero() {
+		reply["expiresAt"] = exp.Unix()
+	}
+
+	return reply
+}
+
+// setExpiry notifies the writer about the expiration time of the current
+// authentication, replacing any value not consumed yet
+func (c *Client) setExpiry(exp time.Time) {
+	select {
+	case <-c.expiry:
+	default:
+	}
+
+	c.expiry <- exp
+}
+
+// expiryTimer tracks the deadlines of the client authentication: the notice
+// asking the peer to re-authenticate and the expiration itself
+type expiryTimer struct {
+	expiresAt time.Time
+	notice    *time.Timer
+	expire    *time.Timer
+}
+
+// reset schedules the deadlines for the provided expiration time. A zero
+// time disables them
+func (t *expiryTimer) reset(exp time.Time, notice time.Duration) {
+	t.stop()
+	t.expiresAt = exp
+	if !exp.IsZero() {
+		t.notice = time.NewTimer(time.Until(exp) - notice)
+		t.expire = time.NewTimer(time.Until(exp))
+	}
+}
+
+// stop cancels any pending deadline
+func (t *expiryTimer) stop() {
+	if t.notice != nil {
+		t.notice.Stop()
+		t.notice = nil
+	}
+
+	if t.expire != nil {
+		t.expire.Stop()
+		t.expire = nil
+	}
+}
+
+// noticeC returns the channel of the notice timer or nil if it is not set
+func (t *expiryTimer) noticeC() <-chan time.Time {
+	if t.notice == nil {
+		return nil
+	}
+
+	return t.notice.C
+}
+
+// expireC returns the channel of the expiration timer or nil if it is not set
+func (t *expiryTimer) expireC() <-chan time.Time {
+	if t.expire == nil {
+		return nil
+	}
+
+	return t.expire.C
+}
+
+// reauthRequired builds the message sent to the peer when the notice fires.
+// The notice is fired only once per expiration time
+func (t *expiryTimer) reauthRequired() map[string]interface{} {
+	t.notice = nil
+	reply := NewReply("reauth_required", "")
+	reply["expiresAt"] = t.expiresAt.Unix()
+	return reply
+}
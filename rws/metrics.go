@@ -0,0 +1,251 @@
+package rws
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bucket upper bounds, in seconds, of the handler latency histogram.
+var latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics collects statistics about connections, messages and Redis
+// listeners, and serves them in the Prometheus text format. Message types
+// are used as labels only if registered in the dispatcher, so that the
+// number of series is bounded. All methods are safe on a nil Metrics.
+type Metrics struct {
+	inboundDepth    int64
+	outboundDepth   int64
+	redisReconnects uint64
+	redisErrors     uint64
+
+	mu          sync.Mutex
+	connected   map[string]int64
+	connections map[string]uint64
+	received    map[string]uint64
+	sent        map[string]uint64
+	latency     map[string]*histogram
+}
+
+// histogram accumulates observations in cumulative buckets
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewMetrics creates a new metrics collector
+func NewMetrics() *Metrics {
+	return &Metrics{
+		connected:   make(map[string]int64),
+		connections: make(map[string]uint64),
+		received:    make(map[string]uint64),
+		sent:        make(map[string]uint64),
+		latency:     make(map[string]*histogram),
+	}
+}
+
+// connect records a client connected through the transport
+func (m *Metrics) connect(transport string) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	m.connected[transport]++
+	m.connections[transport]++
+	m.mu.Unlock()
+}
+
+// disconnect records a client disconnected from the transport
+func (m *Metrics) disconnect(transport string) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	m.connected[transport]--
+	m.mu.Unlock()
+}
+
+// handled records a processed request of type t and the time spent by its handler
+func (m *Metrics) handled(t string, d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.received[t]++
+	h, ok := m.latency[t]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latency[t] = h
+	}
+
+	s := d.Seconds()
+	for i, le := range latencyBuckets {
+		if s <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += s
+}
+
+// sending records a message waiting to be taken by the client writer
+func (m *Metrics) sending() {
+	if m == nil {
+		return
+	}
+
+	atomic.AddInt64(&m.outboundDepth, 1)
+}
+
+// queued records a message from source handed to the client writer
+func (m *Metrics) queued(source string) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	m.sent[source]++
+	m.mu.Unlock()
+}
+
+// dropped records a message abandoned because the client disconnected
+func (m *Metrics) dropped() {
+	if m == nil {
+		return
+	}
+
+	atomic.AddInt64(&m.outboundDepth, -1)
+}
+
+// written records a message taken from the outbound queue
+func (m *Metrics) written() {
+	if m == nil {
+		return
+	}
+
+	atomic.AddInt64(&m.outboundDepth, -1)
+}
+
+// receiving records a request queued for processing
+func (m *Metrics) receiving() {
+	if m == nil {
+		return
+	}
+
+	atomic.AddInt64(&m.inboundDepth, 1)
+}
+
+// processing records a request taken from the inbound queue
+func (m *Metrics) processing() {
+	if m == nil {
+		return
+	}
+
+	atomic.AddInt64(&m.inboundDepth, -1)
+}
+
+// redisReconnect records a new connection of a Redis listener
+func (m *Metrics) redisReconnect() {
+	if m == nil {
+		return
+	}
+
+	atomic.AddUint64(&m.redisReconnects, 1)
+}
+
+// redisError records an error received by a Redis listener
+func (m *Metrics) redisError() {
+	if m == nil {
+		return
+	}
+
+	atomic.AddUint64(&m.redisErrors, 1)
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	if m != nil {
+		m.mu.Lock()
+		writeGauge(&b, "rws_connected_clients", "Number of connected clients.", "transport", m.connected)
+		writeCounter(&b, "rws_connections_total", "Total number of accepted connections.", "transport", m.connections)
+		writeCounter(&b, "rws_messages_received_total", "Total number of processed requests.", "type", m.received)
+		writeCounter(&b, "rws_messages_sent_total", "Total number of messages queued for clients.", "source", m.sent)
+		writeHistogram(&b, "rws_handler_duration_seconds", "Time spent handling requests.", "type", m.latency)
+		m.mu.Unlock()
+
+		writeMetric(&b, "rws_inbound_queue_depth", "Number of requests waiting to be processed.", "gauge", "", strconv.FormatInt(atomic.LoadInt64(&m.inboundDepth), 10))
+		writeMetric(&b, "rws_outbound_queue_depth", "Number of messages waiting to be sent.", "gauge", "", strconv.FormatInt(atomic.LoadInt64(&m.outboundDepth), 10))
+		writeMetric(&b, "rws_redis_reconnects_total", "Total number of Redis listener reconnections.", "counter", "", strconv.FormatUint(atomic.LoadUint64(&m.redisReconnects), 10))
+		writeMetric(&b, "rws_redis_errors_total", "Total number of errors received by Redis listeners.", "counter", "", strconv.FormatUint(atomic.LoadUint64(&m.redisErrors), 10))
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func writeMetric(b *strings.Builder, name, help, kind, labels, value string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n%s%s %s\n", name, help, name, kind, name, labels, value)
+}
+
+func writeGauge(b *strings.Builder, name, help, label string, values map[string]int64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, k := range sortedKeys(values) {
+		fmt.Fprintf(b, "%s{%s=\"%s\"} %d\n", name, label, escape(k), values[k])
+	}
+}
+
+func writeCounter(b *strings.Builder, name, help, label string, values map[string]uint64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, k := range sortedKeys(values) {
+		fmt.Fprintf(b, "%s{%s=\"%s\"} %d\n", name, label, escape(k), values[k])
+	}
+}
+
+func writeHistogram(b *strings.Builder, name, help, label string, values map[string]*histogram) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, k := range sortedKeys(values) {
+		h := values[k]
+		lv := escape(k)
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(b, "%s_bucket{%s=\"%s\",le=\"%s\"} %d\n", name, label, lv, strconv.FormatFloat(le, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket{%s=\"%s\",le=\"+Inf\"} %d\n", name, label, lv, h.count)
+		fmt.Fprintf(b, "%s_sum{%s=\"%s\"} %s\n", name, label, lv, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(b, "%s_count{%s=\"%s\"} %d\n", name, label, lv, h.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// escape escapes a label value
+func escape(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
@@ -0,0 +1,225 @@
+package rws
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/lucalattore/goat"
+)
+
+// OutboxRelay delivers the events stored with goat.Outbox to the Redis channels
+// listened by the websocket clients. Events are delivered at least once: an event
+// is marked as delivered only after it has been published, so it may be published
+// again if the relay fails in between.
+type OutboxRelay struct {
+	RedisPool *redis.Pool
+	Outbox    goat.Outbox
+
+	// Time between polls of the outbox table, 1s if not set
+	PollInterval time.Duration
+
+	// Maximum number of events delivered per transaction, 100 if not set
+	BatchSize int
+
+	// Wakeup, when set, returns a channel signaling new events in the database,
+	// e.g. fed by a listener on Outbox.Notify, to deliver them without waiting
+	// for the next poll. It is not used for tenants sharing the database with
+	// others, which are polled only.
+	Wakeup func(db *sql.DB) <-chan struct{}
+}
+
+// Run runs a relay worker for every opened tenant until the context is canceled.
+// Tenants added to or removed from the MDB are picked up at every poll.
+func (r *OutboxRelay) Run(ctx context.Context, mdb *goat.MDB) {
+	var wg sync.WaitGroup
+	workers := make(map[*goat.TenantHandle]context.CancelFunc)
+	defer func() {
+		for _, cancel := range workers {
+			cancel()
+		}
+		wg.Wait()
+	}()
+
+	ticker := time.NewTicker(r.pollInterval())
+	defer ticker.Stop()
+
+	for {
+		current := make(map[*goat.TenantHandle]bool)
+		for _, th := range mdb.Tenants() {
+			current[th] = true
+			if _, ok := workers[th]; !ok {
+				wctx, cancel := context.WithCancel(ctx)
+				workers[th] = cancel
+				wg.Add(1)
+				go func(th *goat.TenantHandle) {
+					defer wg.Done()
+					r.RunTenant(wctx, th)
+				}(th)
+			}
+		}
+
+		for th, cancel := range workers {
+			if !current[th] {
+				cancel()
+				delete(workers, th)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunDB relays the events stored in the database until the context is canceled
+func (r *OutboxRelay) RunDB(ctx context.Context, db *sql.DB) {
+	r.run(ctx, db, func(ctx context.Context) (int, error) {
+		return r.Deliver(ctx, db)
+	})
+}
+
+// RunTenant relays the events of the tenant until the context is canceled, in
+// transactions scoped to the tenant (see DeliverTenant)
+func (r *OutboxRelay) RunTenant(ctx context.Context, th *goat.TenantHandle) {
+	r.run(ctx, th.DB, func(ctx context.Context) (int, error) {
+		return r.DeliverTenant(ctx, th)
+	})
+}
+
+// run delivers batches of events until the context is canceled, polling the
+// database or waiting to be woken up
+func (r *OutboxRelay) run(ctx context.Context, db *sql.DB, deliver func(context.Context) (int, error)) {
+	var wakeup <-chan struct{}
+	if r.Wakeup != nil && db != nil {
+		wakeup = r.Wakeup(db)
+	}
+
+	ticker := time.NewTicker(r.pollInterval())
+	defer ticker.Stop()
+
+	for {
+		for {
+			n, err := deliver(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Println("Outbox relay error:", err)
+				}
+				break
+			}
+
+			// a full batch means more events are likely pending
+			if n < r.batchSize() {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wakeup:
+		}
+	}
+}
+
+// Deliver publishes a batch of pending events and marks them as delivered,
+// returning the number of events published
+func (r *OutboxRelay) Deliver(ctx context.Context, db *sql.DB) (int, error) {
+	return r.deliver(ctx, func(fn goat.TxFn) error {
+		return goat.WithTransactionContext(ctx, db, nil, fn)
+	})
+}
+
+// DeliverTenant publishes a batch of pending events of the tenant as Deliver does,
+// in a transaction scoped to the tenant if it shares the database with others
+func (r *OutboxRelay) DeliverTenant(ctx context.Context, th *goat.TenantHandle) (int, error) {
+	return r.deliver(ctx, func(fn goat.TxFn) error {
+		return th.WithTransaction(ctx, nil, fn)
+	})
+}
+
+// deliver publishes a batch of pending events in the transaction run by withTx
+func (r *OutboxRelay) deliver(ctx context.Context, withTx func(goat.TxFn) error) (int, error) {
+	table := r.Outbox.TableName()
+	n := 0
+	err := withTx(func(tx goat.Transaction) error {
+		rows, err := tx.QueryContext(ctx, "SELECT id, channel, payload FROM "+table+
+			" WHERE delivered_at IS NULL ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED", r.batchSize())
+		if err != nil {
+			return err
+		}
+
+		type event struct {
+			id      int64
+			channel string
+			payload string
+		}
+
+		events := make([]event, 0)
+		for rows.Next() {
+			var e event
+			if err := rows.Scan(&e.id, &e.channel, &e.payload); err != nil {
+				rows.Close()
+				return err
+			}
+			events = append(events, e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if len(events) == 0 {
+			return nil
+		}
+
+		rconn := r.RedisPool.Get()
+		defer rconn.Close()
+
+		ids := make([]interface{}, 0, len(events))
+		placeholders := make([]string, 0, len(events))
+		for _, e := range events {
+			if _, err := rconn.Do("PUBLISH", e.channel, e.payload); err != nil {
+				return err
+			}
+
+			ids = append(ids, e.id)
+			placeholders = append(placeholders, "$"+strconv.Itoa(len(ids)))
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE "+table+" SET delivered_at = now() WHERE id IN ("+
+			strings.Join(placeholders, ", ")+")", ids...)
+		if err != nil {
+			return err
+		}
+
+		n = len(events)
+		return nil
+	})
+
+	return n, err
+}
+
+func (r *OutboxRelay) pollInterval() time.Duration {
+	if r.PollInterval <= 0 {
+		return time.Second
+	}
+
+	return r.PollInterval
+}
+
+func (r *OutboxRelay) batchSize() int {
+	if r.BatchSize <= 0 {
+		return 100
+	}
+
+	return r.BatchSize
+}
@@ -0,0 +1,196 @@
+package rws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lucalattore/goat"
+	"github.com/lucalattore/goat/sso"
+)
+
+// sseClient binds a client to the Server-Sent Events transport
+type sseClient struct {
+	*Client
+}
+
+// ServeSSE is the function to handle Server-Sent Events requests. It is the
+// fallback transport for peers that cannot open a websocket: the client
+// receives replies and topic messages as events, while requests are sent to
+// ServeSSERequest. The first event carries the client ID to be used by those
+// requests.
+func (h *WSHandler) ServeSSE(dispatcher *Dispatcher, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	authData, _ := r.Context().Value(sso.AuthContextKey).(sso.AuthData)
+	client := &sseClient{Client: h.newClient(authData)}
+	client.metrics.connect("sse")
+
+	pp := h.PingPeriod
+	if pp == 0 {
+		pp = pingPeriod
+	}
+
+	rn := h.ReauthNotice
+	if rn == 0 {
+		rn = reauthNotice
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	h.sse.Store(client.ID, client)
+	defer func() {
+		// the channels are not closed: requests, the processor and the
+		// listener may still be sending, and are stopped by quit instead
+		h.sse.Delete(client.ID)
+		close(client.quit)
+		client.stopListening()
+		client.metrics.disconnect("sse")
+		log.Println("Event stream terminated", client.ID)
+	}()
+
+	go client.listener(h.RedisPool, h.FilterOut, h.TagTopic)
+	go client.process(dispatcher)
+
+	welcome := NewReply("connected", "")
+	welcome["id"] = client.ID
+	if data, err := json.Marshal(welcome); err == nil {
+		writeEvent(w, data)
+		flusher.Flush()
+	}
+
+	client.stream(r.Context(), w, flusher, pp, rn)
+}
+
+// ServeSSERequest is the function to handle requests sent by clients connected
+// through ServeSSE. The client ID is read from the "client" query parameter or
+// the X-Client-ID header; the body is the same JSON message the client would
+// send over the websocket, and the reply is delivered on the event stream.
+func (h *WSHandler) ServeSSERequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := goat.NewHTTPRequest(r).Param("client")
+	if id == "" {
+		id = r.Header.Get("X-Client-ID")
+	}
+
+	v, ok := h.sse.Load(id)
+	if !ok {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	client := v.(*sseClient)
+	authData, _ := r.Context().Value(sso.AuthContextKey).(sso.AuthData)
+	if sub := client.subject(); sub != "" && sub != authData.Subject() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	mmsize := h.MaxMessageSize
+	if mmsize == 0 {
+		mmsize = maxMessageSize
+	}
+
+	message, err := io.ReadAll(io.LimitReader(r.Body, mmsize+1))
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	if int64(len(message)) > mmsize {
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
+	if len(message) == 0 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("received message: '%s' by client %s", message, id)
+	client.metrics.receiving()
+	select {
+	case client.inbound <- message:
+		w.WriteHeader(http.StatusAccepted)
+	case <-client.quit:
+		client.metrics.processing()
+		http.Error(w, "Not Found", http.StatusNotFound)
+	case <-r.Context().Done():
+		client.metrics.processing()
+	}
+}
+
+// stream pumps messages from the hub to the event stream until the request
+// is canceled or the authentication expires.
+func (c *sseClient) stream(ctx context.Context, w io.Writer, flusher http.Flusher, pingPeriod, reauthNotice time.Duration) {
+	ticker := time.NewTicker(pingPeriod)
+	var et expiryTimer
+	defer func() {
+		ticker.Stop()
+		et.stop()
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case exp := <-c.expiry:
+			et.reset(exp, reauthNotice)
+		case <-et.noticeC():
+			if data, err := json.Marshal(et.reauthRequired()); err == nil {
+				writeEvent(w, data)
+				flusher.Flush()
+			}
+		case <-et.expireC():
+			log.Println("Client", c.ID, "authentication expired")
+			if data, err := json.Marshal(NewError("401", "authentication expired")); err == nil {
+				writeEvent(w, data)
+				flusher.Flush()
+			}
+			return
+		case message := <-c.outbound:
+			log.Println("sending message to client ", c.ID)
+			c.metrics.written()
+			writeEvent(w, message)
+
+			// Add queued messages to the current flush.
+			n := len(c.outbound)
+			for i := 0; i < n; i++ {
+				log.Println("sending message to client ", c.ID)
+				c.metrics.written()
+				writeEvent(w, <-c.outbound)
+			}
+
+			flusher.Flush()
+		case <-ticker.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// writeEvent writes the message as a single event, splitting it in multiple
+// data lines if needed
+func writeEvent(w io.Writer, message []byte) {
+	for _, line := range bytes.Split(message, newline) {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
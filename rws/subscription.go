@@ -16,7 +16,7 @@ func (p *WSChannelParams) Subscribe(c *Client, r *map[string]interface{}) interf
 	if ch, ok := (*r)["topic"].(string); ok {
 		if strings.HasPrefix(ch, p.TopicPrefix+":") {
 			log.Println("Client", c.ID, "subscribing to topic", ch)
-			err := c.psc.Subscribe(ch)
+			err := c.subscribe(ch)
 			if err != nil {
 				log.Println(err)
 			}
@@ -31,7 +31,7 @@ func (p *WSChannelParams) Subscribe(c *Client, r *map[string]interface{}) interf
 
 		if len(topics) > 0 {
 			log.Println("Client", c.ID, "subscribing to topics", topics)
-			err := c.psc.Subscribe(topics...)
+			err := c.subscribe(topics...)
 			if err != nil {
 				log.Println(err)
 			}
@@ -46,7 +46,7 @@ func (p *WSChannelParams) Unsubscribe(c *Client, r *map[string]interface{}) inte
 	if ch, ok := (*r)["topic"].(string); ok {
 		if strings.HasPrefix(ch, p.TopicPrefix+":") {
 			log.Println("Client", c.ID, "unsubscribing from topic", ch)
-			err := c.psc.Unsubscribe(ch)
+			err := c.unsubscribe(ch)
 			if err != nil {
 				log.Println(err)
 			}
@@ -61,12 +61,12 @@ func (p *WSChannelParams) Unsubscribe(c *Client, r *map[string]interface{}) inte
 
 		if len(topics) > 0 {
 			log.Println("Client", c.ID, "unsubscribing from topics", topics)
-			err := c.psc.Unsubscribe(topics...)
+			err := c.unsubscribe(topics...)
 			if err != nil {
 				log.Println(err)
 			}
 		} else {
-			err := c.psc.PUnsubscribe(p.TopicPrefix + ":*")
+			err := c.punsubscribe(p.TopicPrefix + ":*")
 			if err != nil {
 				log.Println(err)
 			}
@@ -3,8 +3,10 @@ package rws
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
@@ -25,6 +27,9 @@ const (
 
 	// Maximum message size allowed from peer.
 	maxMessageSize = 512
+
+	// Time before token expiration to ask the peer to re-authenticate.
+	reauthNotice = time.Minute
 )
 
 var (
@@ -32,6 +37,10 @@ var (
 	space   = []byte{' '}
 )
 
+// errNotListening is returned when changing the subscriptions of a client whose
+// listener is not connected to Redis yet
+var errNotListening = errors.New("client not listening")
+
 // Client is a middleman between the websocket connection and the request engine.
 type Client struct {
 	// Unique Client ID
@@ -40,6 +49,9 @@ type Client struct {
 	// Authentication data
 	AuthData sso.AuthData
 
+	// Guards AuthData, replaced on re-authentication.
+	authMu sync.RWMutex
+
 	// The websocket connection.
 	conn *websocket.Conn
 
@@ -49,8 +61,24 @@ type Client struct {
 	// Buffered channel of outbound messages.
 	outbound chan []byte
 
-	// Redis PubSub
+	// Redis PubSub, replaced by the listener when it reconnects.
 	psc *redis.PubSubConn
+
+	// Guards psc and serializes the subscription changes.
+	pscMu sync.Mutex
+
+	// Parameters used to validate re-authentication requests.
+	auth *sso.AuthParams
+
+	// Expiration time of the current authentication, consumed by the writer.
+	expiry chan time.Time
+
+	// Metrics collector, may be nil.
+	metrics *Metrics
+
+	// Closed when the client disconnects, to stop the goroutines sending to
+	// the inbound and outbound channels.
+	quit chan struct{}
 }
 
 // Dispatcher keep registerd function to handle ws request
@@ -121,6 +149,24 @@ type WSHandler struct {
 	PongWait       time.Duration
 	PingPeriod     time.Duration
 	MaxMessageSize int64
+
+	// TagTopic, when set, adds a "topic" attribute holding the Redis channel
+	// to the JSON messages forwarded from subscribed topics.
+	TagTopic bool
+
+	// Auth, when set, enables token expiry tracking: the client receives a
+	// "reauth_required" message ReauthNotice before the token expires and
+	// may send an "auth" request with a new token of the same subject, which
+	// must expire too if the current one does. If the token lapses the
+	// connection is closed with a policy violation.
+	Auth         *sso.AuthParams
+	ReauthNotice time.Duration
+
+	// Metrics, when set, collects connection, message and Redis statistics.
+	Metrics *Metrics
+
+	// Clients connected through the SSE transport
+	sse sync.Map
 }
 
 // ServeWS is the function to handle websocket request. You have to register it into your http mux
@@ -132,10 +178,9 @@ func (h *WSHandler) ServeWS(dispatcher *Dispatcher, w http.ResponseWriter, r *ht
 		return
 	}
 
-	id := uuid.New().String()
-	log.Println("Client", id, "connected as user", authData.PreferredUsername())
-	client := &Client{ID: id, conn: conn, inbound: make(chan []byte), outbound: make(chan []byte), AuthData: authData}
-	done := make(chan bool, 1)
+	client := h.newClient(authData)
+	client.conn = conn
+	client.metrics.connect("ws")
 
 	ww := h.WriteWait
 	if ww == 0 {
@@ -157,10 +202,30 @@ func (h *WSHandler) ServeWS(dispatcher *Dispatcher, w http.ResponseWriter, r *ht
 		mmsize = maxMessageSize
 	}
 
-	go client.listener(h.RedisPool, h.FilterOut, done)
+	rn := h.ReauthNotice
+	if rn == 0 {
+		rn = reauthNotice
+	}
+
+	go client.listener(h.RedisPool, h.FilterOut, h.TagTopic)
 	go client.process(dispatcher)
-	go client.write(ww, pp)
-	go client.receive(done, pw, mmsize)
+	go client.write(ww, pp, rn)
+	go client.receive(pw, mmsize)
+}
+
+// newClient creates a new client, not yet bound to any transport
+func (h *WSHandler) newClient(authData sso.AuthData) *Client {
+	id := uuid.New().String()
+	log.Println("Client", id, "connected as user", authData.PreferredUsername())
+	client := &Client{ID: id, inbound: make(chan []byte), outbound: make(chan []byte), AuthData: authData, metrics: h.Metrics,
+		quit: make(chan struct{})}
+	if h.Auth != nil {
+		client.auth = h.Auth
+		client.expiry = make(chan time.Time, 1)
+		client.setExpiry(authData.ExpiresAt())
+	}
+
+	return client
 }
 
 // receive pumps messages from the websocket connection to the hub.
@@ -168,13 +233,12 @@ func (h *WSHandler) ServeWS(dispatcher *Dispatcher, w http.ResponseWriter, r *ht
 // The application runs receive in a per-connection goroutine. The application
 // ensures that there is at most one reader on a connection by executing all
 // reads from this goroutine.
-func (c *Client) receive(done chan bool, pongWait time.Duration, maxMessageSize int64) {
+func (c *Client) receive(pongWait time.Duration, maxMessageSize int64) {
 	defer func() {
-		done <- true
+		close(c.quit)
 		c.conn.Close()
-		c.psc.Unsubscribe()
-		close(c.outbound)
-		close(c.inbound)
+		c.stopListening()
+		c.metrics.disconnect("ws")
 		log.Println("Receiver terminated", c.ID)
 	}()
 	c.conn.SetReadLimit(maxMessageSize)
@@ -191,6 +255,7 @@ func (c *Client) receive(done chan bool, pongWait time.Duration, maxMessageSize
 		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
 		if len(message) > 0 {
 			log.Printf("received message: '%s' by client %s", message, c.ID)
+			c.metrics.receiving()
 			c.inbound <- message
 		}
 	}
@@ -201,23 +266,36 @@ func (c *Client) receive(done chan bool, pongWait time.Duration, maxMessageSize
 // A goroutine running write is started for each connection. The
 // application ensures that there is at most one writer to a connection by
 // executing all writes from this goroutine.
-func (c *Client) write(writeWait, pingPeriod time.Duration) {
+func (c *Client) write(writeWait, pingPeriod, reauthNotice time.Duration) {
 	ticker := time.NewTicker(pingPeriod)
+	var et expiryTimer
 	defer func() {
 		ticker.Stop()
+		et.stop()
 		c.conn.Close()
 		log.Println("Writer terminated", c.ID)
 	}()
 	for {
 		select {
-		case message, ok := <-c.outbound:
+		case exp := <-c.expiry:
+			et.reset(exp, reauthNotice)
+		case <-et.noticeC():
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			if err := c.conn.WriteJSON(et.reauthRequired()); err != nil {
 				return
 			}
-
+		case <-et.expireC():
+			log.Println("Client", c.ID, "authentication expired")
+			msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "authentication expired")
+			c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+			return
+		case <-c.quit:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
+		case message := <-c.outbound:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.metrics.written()
 			w, err := c.conn.NextWriter(websocket.TextMessage)
 			if err != nil {
 				return
@@ -229,6 +307,7 @@ func (c *Client) write(writeWait, pingPeriod time.Duration) {
 			n := len(c.outbound)
 			for i := 0; i < n; i++ {
 				log.Println("sending message to client ", c.ID)
+				c.metrics.written()
 				w.Write(<-c.outbound)
 			}
 
@@ -247,72 +326,87 @@ func (c *Client) write(writeWait, pingPeriod time.Duration) {
 func (c *Client) process(dispatcher *Dispatcher) {
 	for {
 		select {
-		case message, ok := <-c.inbound:
-			if !ok {
-				log.Println("Processor terminated", c.ID)
-				return
-			}
-
+		case <-c.quit:
+			log.Println("Processor terminated", c.ID)
+			return
+		case message := <-c.inbound:
+			c.metrics.processing()
 			log.Printf("processing message: '%s'", message)
 
+			start := time.Now()
+			label := "unknown"
 			var input map[string]interface{}
 			var output interface{}
 			err := json.Unmarshal(message, &input)
 			if err != nil {
 				log.Println(err)
+				label = "invalid"
 				output = NewError("400", "Invalid Request")
 			} else if t, ok := input["type"].(string); ok {
-				if f, ok := dispatcher.h[t]; ok {
+				if t == "auth" && c.auth != nil {
+					label = t
+					output = c.reauthenticate(&input)
+				} else if f, ok := dispatcher.h[t]; ok {
+					label = t
 					output = f(c, &input)
 				} else {
 					output = NewError("400", "Unknown Request '"+t+"'")
 				}
 			}
+			c.metrics.handled(label, time.Since(start))
 
 			if output != nil {
+				correlate(output, input["correlationId"])
 				response, err := json.Marshal(output)
 				if err != nil {
 					log.Println("Error marshaling outgoing mesasge", output)
 				} else {
-					c.outbound <- response
+					c.send(response, "reply")
 				}
 			}
 		}
 	}
 }
 
-// listener receive pubilshed message in redis channel subscribed by the client
-func (c *Client) listener(rdb *redis.Pool, filterOut bool, done chan bool) {
+// listener receive pubilshed message in redis channel subscribed by the client,
+// until the client disconnects
+func (c *Client) listener(rdb *redis.Pool, filterOut, tagTopic bool) {
+	inbox := "client:" + c.ID
 	cmap := make(map[string]bool)
-	cmap["client:"+c.ID] = true
+	cmap[inbox] = true
 
-	for {
-		rconn := rdb.Get()
-		c.psc = &redis.PubSubConn{Conn: rconn}
-
-		var err error
-		for ch := range cmap {
-			if err = c.psc.Subscribe(ch); err != nil {
-				log.Println("Got error", err)
-				break
-			}
+	for i := 0; ; i++ {
+		if i > 0 {
+			c.metrics.redisReconnect()
+		}
+
+		psc, err := c.listen(rdb, cmap)
+		if psc == nil {
+			log.Println("Client", c.ID, "listener terminated")
+			return
 		}
 
 		log.Println("Client", c.ID, "listening")
 	loop:
-		for rconn.Err() == nil && err == nil {
-			switch x := c.psc.Receive().(type) {
+		for psc.Conn.Err() == nil && err == nil {
+			switch x := psc.Receive().(type) {
 			case error:
 				log.Println("Client", c.ID, "; redis Listener got error", x)
+				c.metrics.redisError()
 
 			case redis.Message:
 				log.Println("Client", c.ID, "received message from channel", x.Channel)
+				data := x.Data
 				if filterOut {
-					if data := c.filter(x.Data); data != nil {
-						c.outbound <- data
-					}
-				} else if x.Data != nil {
-					c.outbound <- x.Data
+					data = c.filter(data)
+				}
+
+				if tagTopic && data != nil && x.Channel != inbox {
+					data = tag(data, x.Channel)
+				}
+
+				if data != nil {
+					c.send(data, "pubsub")
 				}
 
 			case redis.Subscription:
@@ -329,16 +423,94 @@ func (c *Client) listener(rdb *redis.Pool, filterOut bool, done chan bool) {
 			}
 		}
 
-		rconn.Close()
+		psc.Close()
+	}
+}
 
-		select {
-		case <-done:
-			log.Println("Client", c.ID, "listener terminated")
-			return
-		default:
-			break
+// listen opens a Redis connection subscribed to the channels, returning an
+// error if subscribing fails, or nil once the client has disconnected
+func (c *Client) listen(rdb *redis.Pool, channels map[string]bool) (*redis.PubSubConn, error) {
+	c.pscMu.Lock()
+	defer c.pscMu.Unlock()
+
+	select {
+	case <-c.quit:
+		return nil, nil
+	default:
+	}
+
+	c.psc = &redis.PubSubConn{Conn: rdb.Get()}
+	for ch := range channels {
+		if err := c.psc.Subscribe(ch); err != nil {
+			log.Println("Got error", err)
+			return c.psc, err
 		}
 	}
+
+	return c.psc, nil
+}
+
+// stopListening unsubscribes the listener from all the channels, so that it
+// stops receiving and, since the client has disconnected, terminates
+func (c *Client) stopListening() {
+	c.pscMu.Lock()
+	defer c.pscMu.Unlock()
+
+	if c.psc != nil {
+		c.psc.Unsubscribe()
+	}
+}
+
+// subscribe subscribes the listener to the channels
+func (c *Client) subscribe(channels ...interface{}) error {
+	c.pscMu.Lock()
+	defer c.pscMu.Unlock()
+
+	if c.psc == nil {
+		return errNotListening
+	}
+	return c.psc.Subscribe(channels...)
+}
+
+// unsubscribe unsubscribes the listener from the channels
+func (c *Client) unsubscribe(channels ...interface{}) error {
+	c.pscMu.Lock()
+	defer c.pscMu.Unlock()
+
+	if c.psc == nil {
+		return errNotListening
+	}
+	return c.psc.Unsubscribe(channels...)
+}
+
+// punsubscribe unsubscribes the listener from the patterns
+func (c *Client) punsubscribe(patterns ...interface{}) error {
+	c.pscMu.Lock()
+	defer c.pscMu.Unlock()
+
+	if c.psc == nil {
+		return errNotListening
+	}
+	return c.psc.PUnsubscribe(patterns...)
+}
+
+// send queues the message for the peer, unless the client disconnects first
+func (c *Client) send(message []byte, source string) {
+	c.metrics.sending()
+	select {
+	case c.outbound <- message:
+		c.metrics.queued(source)
+	case <-c.quit:
+		c.metrics.dropped()
+	}
+}
+
+// subject returns the subject the client is authenticated as
+func (c *Client) subject() string {
+	c.authMu.RLock()
+	defer c.authMu.RUnlock()
+
+	return c.AuthData.Subject()
 }
 
 func (c *Client) filter(data []byte) []byte {
@@ -355,3 +527,47 @@ func (c *Client) filter(data []byte) []byte {
 
 	return data
 }
+
+// tag adds the topic attribute to the message published in the channel.
+// Messages that are not JSON objects are forwarded as they are
+func tag(data []byte, channel string) []byte {
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return data
+	}
+
+	if _, ok := m["topic"]; ok {
+		return data
+	}
+
+	m["topic"] = channel
+	tagged, err := json.Marshal(m)
+	if err != nil {
+		log.Println(err)
+		return data
+	}
+
+	return tagged
+}
+
+// correlate copies the correlation ID of the request into the reply, so that
+// the peer can match replies with pending requests
+func correlate(output interface{}, id interface{}) {
+	if id == nil {
+		return
+	}
+
+	var m map[string]interface{}
+	switch x := output.(type) {
+	case map[string]interface{}:
+		m = x
+	case *map[string]interface{}:
+		m = *x
+	default:
+		return
+	}
+
+	if _, ok := m["correlationId"]; !ok {
+		m["correlationId"] = id
+	}
+}
@@ -0,0 +1,553 @@
+// Package rwsclient implements a client for the websocket protocol served by
+// rws.WSHandler.
+package rwsclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Time allowed to write a message to the server.
+	writeWait = 10 * time.Second
+
+	// Time allowed to read the next ping message from the server. It must be
+	// greater than the PingPeriod of the server.
+	pongWait = 30 * time.Second
+
+	// Default time allowed to receive the reply of a request.
+	requestTimeout = 30 * time.Second
+
+	// Bounds of the delay between reconnection attempts.
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+var (
+	// ErrNotConnected is returned when a message cannot be sent because the
+	// connection is down
+	ErrNotConnected = errors.New("rwsclient: not connected")
+
+	// ErrClosed is returned when the client has been closed
+	ErrClosed = errors.New("rwsclient: client closed")
+)
+
+// Message is a message received from the server
+type Message map[string]interface{}
+
+// Type get the type of the message
+func (m Message) Type() string {
+	t, _ := m["type"].(string)
+	return t
+}
+
+// Topic get the topic the message was published to, if any
+func (m Message) Topic() string {
+	t, _ := m["topic"].(string)
+	return t
+}
+
+// Decode decodes the message into v
+func (m Message) Decode(v interface{}) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// Error is the error replied by the server
+type Error struct {
+	Code string
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.Msg == "" {
+		return "rwsclient: error " + e.Code
+	}
+
+	return "rwsclient: error " + e.Code + ": " + e.Msg
+}
+
+// Options describes the client customization
+type Options struct {
+	// Bearer token sent when connecting
+	Token string
+
+	// RefreshToken, when set, is called to get a new token when the server
+	// asks to re-authenticate and before reconnecting
+	RefreshToken func(ctx context.Context) (string, error)
+
+	// Additional headers sent when connecting
+	Header http.Header
+
+	// Dialer used to connect, websocket.DefaultDialer if nil
+	Dialer *websocket.Dialer
+
+	WriteWait      time.Duration
+	PongWait       time.Duration
+	RequestTimeout time.Duration
+	MinBackoff     time.Duration
+	MaxBackoff     time.Duration
+
+	// OnMessage receives the messages that are neither replies nor bound to
+	// a subscribed topic
+	OnMessage func(msg Message)
+
+	// OnConnect is called every time the connection is established
+	OnConnect func()
+}
+
+// Client is a connection to an rws endpoint that reconnects automatically.
+// Callbacks are called by the goroutine reading from the connection and
+// must not block.
+type Client struct {
+	url  string
+	opts Options
+	seq  uint64
+
+	mu      sync.Mutex
+	conn    *websocket.Conn
+	token   string
+	pending map[string]chan Message
+	topics  map[string]func(msg Message)
+
+	wmu    sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Dial connects to the rws endpoint at the provided URL. It fails if the
+// first connection attempt fails; afterwards the client reconnects with
+// backoff until it is closed.
+func Dial(ctx context.Context, url string, opts Options) (*Client, error) {
+	if opts.Dialer == nil {
+		opts.Dialer = websocket.DefaultDialer
+	}
+
+	if opts.WriteWait == 0 {
+		opts.WriteWait = writeWait
+	}
+
+	if opts.PongWait == 0 {
+		opts.PongWait = pongWait
+	}
+
+	if opts.RequestTimeout == 0 {
+		opts.RequestTimeout = requestTimeout
+	}
+
+	if opts.MinBackoff == 0 {
+		opts.MinBackoff = minBackoff
+	}
+
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = maxBackoff
+	}
+
+	c := &Client{
+		url:     url,
+		opts:    opts,
+		token:   opts.Token,
+		pending: make(map[string]chan Message),
+		topics:  make(map[string]func(msg Message)),
+		done:    make(chan struct{}),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	conn, err := c.connect(ctx)
+	if err != nil {
+		c.cancel()
+		return nil, err
+	}
+
+	c.attach(conn)
+	go c.run(conn)
+	return c, nil
+}
+
+// Close terminates the connection and stops reconnecting
+func (c *Client) Close() error {
+	c.cancel()
+
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	var err error
+	if conn != nil {
+		msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(c.opts.WriteWait))
+		err = conn.Close()
+	}
+
+	<-c.done
+	return err
+}
+
+// Send sends a message of the provided type without waiting for a reply.
+// The payload, if not nil, must encode to a JSON object.
+func (c *Client) Send(t string, payload interface{}) error {
+	m, err := envelope(t, payload)
+	if err != nil {
+		return err
+	}
+
+	return c.write(m)
+}
+
+// Request sends a message of the provided type and waits for the reply,
+// decoding it into reply if not nil. An error replied by the server is
+// returned as *Error.
+func (c *Client) Request(ctx context.Context, t string, payload, reply interface{}) error {
+	m, err := envelope(t, payload)
+	if err != nil {
+		return err
+	}
+
+	id := strconv.FormatUint(atomic.AddUint64(&c.seq, 1), 10)
+	m["correlationId"] = id
+
+	ch := make(chan Message, 1)
+	c.mu.Lock()
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	if err := c.write(m); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(c.opts.RequestTimeout)
+	defer timer.Stop()
+
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			return ErrNotConnected
+		}
+
+		if msg.Type() == "error" {
+			e := &Error{}
+			e.Code, _ = msg["code"].(string)
+			e.Msg, _ = msg["msg"].(string)
+			return e
+		}
+
+		if reply != nil {
+			return msg.Decode(reply)
+		}
+
+		return nil
+	case <-timer.C:
+		return context.DeadlineExceeded
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.ctx.Done():
+		return ErrClosed
+	}
+}
+
+// Subscribe subscribes to the topic, calling fn for any message published
+// to it. The subscription is restored after reconnecting. Messages are bound
+// to the topic by their "topic" attribute, see rws.WSHandler.TagTopic.
+func (c *Client) Subscribe(topic string, fn func(msg Message)) error {
+	c.mu.Lock()
+	c.topics[topic] = fn
+	c.mu.Unlock()
+
+	err := c.Send("subscribe", map[string]interface{}{"topic": topic})
+	if err == ErrNotConnected {
+		// subscribed on reconnection
+		return nil
+	}
+
+	return err
+}
+
+// Unsubscribe unsubscribes from the topic
+func (c *Client) Unsubscribe(topic string) error {
+	c.mu.Lock()
+	delete(c.topics, topic)
+	c.mu.Unlock()
+
+	err := c.Send("unsubscribe", map[string]interface{}{"topic": topic})
+	if err == ErrNotConnected {
+		return nil
+	}
+
+	return err
+}
+
+// envelope builds the message to send to the server
+func envelope(t string, payload interface{}) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+	}
+
+	m["type"] = t
+	return m, nil
+}
+
+// write sends the message over the current connection
+func (c *Client) write(m map[string]interface{}) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	if c.ctx.Err() != nil {
+		return ErrClosed
+	}
+
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	conn.SetWriteDeadline(time.Now().Add(c.opts.WriteWait))
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// connect opens a new connection to the server
+func (c *Client) connect(ctx context.Context) (*websocket.Conn, error) {
+	header := http.Header{}
+	for k, v := range c.opts.Header {
+		header[k] = v
+	}
+
+	c.mu.Lock()
+	token := c.token
+	c.mu.Unlock()
+
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	conn, _, err := c.opts.Dialer.DialContext(ctx, c.url, header)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(c.opts.PongWait))
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(c.opts.PongWait))
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(c.opts.WriteWait))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+
+		return err
+	})
+
+	return conn, nil
+}
+
+// run reads from the connection and reconnects when it is lost
+func (c *Client) run(conn *websocket.Conn) {
+	defer close(c.done)
+
+	for {
+		c.read(conn)
+		c.detach()
+
+		conn = c.reconnect()
+		if conn == nil {
+			return
+		}
+
+		c.attach(conn)
+	}
+}
+
+// attach makes the connection the current one and restores subscriptions
+func (c *Client) attach(conn *websocket.Conn) {
+	c.mu.Lock()
+	c.conn = conn
+	topics := make([]interface{}, 0, len(c.topics))
+	for topic := range c.topics {
+		topics = append(topics, topic)
+	}
+	c.mu.Unlock()
+
+	if len(topics) > 0 {
+		if err := c.Send("subscribe", map[string]interface{}{"topic": topics}); err != nil {
+			log.Println("rwsclient: restoring subscriptions:", err)
+		}
+	}
+
+	if c.opts.OnConnect != nil {
+		c.opts.OnConnect()
+	}
+}
+
+// detach drops the current connection and fails pending requests
+func (c *Client) detach() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+// reconnect tries to connect with exponential backoff and jitter until it
+// succeeds or the client is closed
+func (c *Client) reconnect() *websocket.Conn {
+	backoff := c.opts.MinBackoff
+	for {
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-time.After(delay):
+		case <-c.ctx.Done():
+			return nil
+		}
+
+		if c.opts.RefreshToken != nil {
+			c.refreshToken()
+		}
+
+		conn, err := c.connect(c.ctx)
+		if err == nil {
+			return conn
+		}
+
+		log.Println("rwsclient: reconnecting:", err)
+		backoff *= 2
+		if backoff > c.opts.MaxBackoff {
+			backoff = c.opts.MaxBackoff
+		}
+	}
+}
+
+// read pumps messages from the connection until it fails
+func (c *Client) read(conn *websocket.Conn) {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if c.ctx.Err() == nil {
+				log.Println("rwsclient: connection lost:", err)
+			}
+			return
+		}
+
+		conn.SetReadDeadline(time.Now().Add(c.opts.PongWait))
+
+		// the server may pack several messages in a single frame
+		dec := json.NewDecoder(bytes.NewReader(data))
+		for dec.More() {
+			var msg Message
+			if err := dec.Decode(&msg); err != nil {
+				log.Println("rwsclient: invalid message:", err)
+				break
+			}
+
+			c.dispatch(msg)
+		}
+	}
+}
+
+// dispatch routes the received message to the pending request, the topic
+// callback or OnMessage
+func (c *Client) dispatch(msg Message) {
+	if id, ok := msg["correlationId"].(string); ok {
+		c.mu.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+
+		if ok {
+			ch <- msg
+			return
+		}
+	}
+
+	if msg.Type() == "reauth_required" && c.opts.RefreshToken != nil {
+		go c.reauthenticate()
+		return
+	}
+
+	if topic := msg.Topic(); topic != "" {
+		c.mu.Lock()
+		fn, ok := c.topics[topic]
+		c.mu.Unlock()
+
+		if ok {
+			fn(msg)
+			return
+		}
+	}
+
+	if c.opts.OnMessage != nil {
+		c.opts.OnMessage(msg)
+	}
+}
+
+// refreshToken gets a new token through RefreshToken
+func (c *Client) refreshToken() (string, error) {
+	token, err := c.opts.RefreshToken(c.ctx)
+	if err != nil {
+		log.Println("rwsclient: refreshing token:", err)
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.token = token
+	c.mu.Unlock()
+
+	return token, nil
+}
+
+// reauthenticate sends a new token to the server before the current one expires
+func (c *Client) reauthenticate() {
+	token, err := c.refreshToken()
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, c.opts.RequestTimeout)
+	defer cancel()
+
+	if err := c.Request(ctx, "auth", map[string]interface{}{"token": token}, nil); err != nil {
+		log.Println("rwsclient: re-authentication failed:", err)
+	}
+}
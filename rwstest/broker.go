@@ -0,0 +1,295 @@
+package rwstest
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var errConnClosed = errors.New("rwstest: connection closed")
+
+// Broker is an in-memory replacement of the Redis publish/subscribe
+// commands used by rws
+type Broker struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	conns map[*fakeConn]bool
+}
+
+// NewBroker creates a new broker
+func NewBroker() *Broker {
+	b := &Broker{conns: make(map[*fakeConn]bool)}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// Pool returns a redis pool whose connections are served by the broker
+func (b *Broker) Pool() *redis.Pool {
+	return &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return b.newConn(), nil
+		},
+	}
+}
+
+// Publish publishes the message to the channel and returns the number of
+// connections that received it
+func (b *Broker) Publish(channel string, data []byte) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := 0
+	for c := range b.conns {
+		if c.channels[channel] {
+			c.push([]interface{}{[]byte("message"), []byte(channel), data})
+			n++
+		}
+
+		for pattern := range c.patterns {
+			if match(pattern, channel) {
+				c.push([]interface{}{[]byte("pmessage"), []byte(pattern), []byte(channel), data})
+				n++
+			}
+		}
+	}
+
+	return n
+}
+
+// Subscribed reports whether the connection subscribed to the inbox channel
+// is also subscribed to the provided channel
+func (b *Broker) Subscribed(inbox, channel string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.subscribed(inbox, channel)
+}
+
+func (b *Broker) subscribed(inbox, channel string) bool {
+	for c := range b.conns {
+		if c.channels[inbox] {
+			return c.channels[channel] || c.matches(channel)
+		}
+	}
+
+	return false
+}
+
+// inboxes returns the channels with the provided prefix currently subscribed
+func (b *Broker) inboxes(prefix string) []string {
+	chs := make([]string, 0)
+	for c := range b.conns {
+		for ch := range c.channels {
+			if strings.HasPrefix(ch, prefix) {
+				chs = append(chs, ch)
+			}
+		}
+	}
+
+	return chs
+}
+
+func (b *Broker) newConn() *fakeConn {
+	c := &fakeConn{broker: b, channels: make(map[string]bool), patterns: make(map[string]bool)}
+	b.mu.Lock()
+	b.conns[c] = true
+	b.mu.Unlock()
+	return c
+}
+
+// fakeConn implements redis.Conn on top of the broker. Commands are executed
+// when sent and replies are queued until received.
+type fakeConn struct {
+	broker   *Broker
+	channels map[string]bool
+	patterns map[string]bool
+	replies  []interface{}
+	closed   bool
+}
+
+// push queues a reply. The broker lock must be held
+func (c *fakeConn) push(reply interface{}) {
+	c.replies = append(c.replies, reply)
+	c.broker.cond.Broadcast()
+}
+
+// matches reports whether any pattern matches the channel. The broker lock
+// must be held
+func (c *fakeConn) matches(channel string) bool {
+	for pattern := range c.patterns {
+		if match(pattern, channel) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *fakeConn) Close() error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c.closed = true
+	delete(b.conns, c)
+	b.cond.Broadcast()
+	return nil
+}
+
+func (c *fakeConn) Err() error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c.closed {
+		return errConnClosed
+	}
+
+	return nil
+}
+
+func (c *fakeConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	if commandName == "" {
+		return nil, c.Err()
+	}
+
+	switch strings.ToUpper(commandName) {
+	case "PUBLISH":
+		if len(args) != 2 {
+			return nil, errors.New("rwstest: wrong number of arguments for PUBLISH")
+		}
+
+		data, err := redis.Bytes(args[1], nil)
+		if err != nil {
+			data = []byte(fmt.Sprint(args[1]))
+		}
+
+		return int64(c.broker.Publish(fmt.Sprint(args[0]), data)), nil
+	case "PING":
+		return "PONG", nil
+	}
+
+	if err := c.Send(commandName, args...); err != nil {
+		return nil, err
+	}
+
+	return c.Receive()
+}
+
+func (c *fakeConn) Send(commandName string, args ...interface{}) error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c.closed {
+		return errConnClosed
+	}
+
+	switch cmd := strings.ToLower(commandName); cmd {
+	case "subscribe", "psubscribe":
+		set := c.channels
+		if cmd == "psubscribe" {
+			set = c.patterns
+		}
+
+		for _, arg := range args {
+			ch := fmt.Sprint(arg)
+			set[ch] = true
+			c.push([]interface{}{[]byte(cmd), []byte(ch), int64(len(c.channels) + len(c.patterns))})
+		}
+	case "unsubscribe", "punsubscribe":
+		set := c.channels
+		if cmd == "punsubscribe" {
+			set = c.patterns
+		}
+
+		chs := make([]string, 0, len(args))
+		for _, arg := range args {
+			chs = append(chs, fmt.Sprint(arg))
+		}
+
+		if len(chs) == 0 {
+			for ch := range set {
+				chs = append(chs, ch)
+			}
+		}
+
+		if len(chs) == 0 {
+			c.push([]interface{}{[]byte(cmd), nil, int64(len(c.channels) + len(c.patterns))})
+		}
+
+		for _, ch := range chs {
+			delete(set, ch)
+			c.push([]interface{}{[]byte(cmd), []byte(ch), int64(len(c.channels) + len(c.patterns))})
+		}
+	case "ping":
+		c.push([]interface{}{[]byte("pong"), []byte("")})
+	case "echo":
+		if len(args) > 0 {
+			c.push(args[0])
+		}
+	default:
+		return fmt.Errorf("rwstest: unsupported command %s", commandName)
+	}
+
+	return nil
+}
+
+func (c *fakeConn) Flush() error {
+	return c.Err()
+}
+
+func (c *fakeConn) Receive() (interface{}, error) {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for len(c.replies) == 0 && !c.closed {
+		b.cond.Wait()
+	}
+
+	if len(c.replies) == 0 {
+		return nil, errConnClosed
+	}
+
+	reply := c.replies[0]
+	c.replies = c.replies[1:]
+	return reply, nil
+}
+
+// match reports whether the channel matches the glob-style pattern, as
+// supported by PSUBSCRIBE
+func match(pattern, channel string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(channel); i >= 0; i-- {
+				if match(pattern[1:], channel[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(channel) == 0 {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(channel) == 0 || channel[0] != pattern[0] {
+				return false
+			}
+		}
+
+		pattern = pattern[1:]
+		channel = channel[1:]
+	}
+
+	return len(channel) == 0
+}
@@ -0,0 +1,315 @@
+// Package rwstest provides utilities to test rws dispatchers: an in-process
+// server backed by an in-memory broker and scripted websocket clients.
+package rwstest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/lucalattore/goat/rws"
+	"github.com/lucalattore/goat/rwsclient"
+	"github.com/lucalattore/goat/sso"
+)
+
+// Timeout is the default time allowed to wait for an expected event
+var Timeout = 2 * time.Second
+
+// authHeader carries the key of the auth data injected in the connection
+const authHeader = "X-Rwstest-Auth"
+
+// Server is a WSHandler served over httptest with an in-memory broker
+type Server struct {
+	// URL of the websocket endpoint
+	URL string
+
+	// Handler serving the websocket connections
+	Handler *rws.WSHandler
+
+	// Broker replacing Redis
+	Broker *Broker
+
+	tb      testing.TB
+	srv     *httptest.Server
+	auth    sync.Map
+	mu      sync.Mutex
+	clients map[string]bool
+}
+
+// NewServer starts a server handling websocket connections with the
+// dispatcher. The handler, if not nil, provides the server customization;
+// its RedisPool is replaced by the broker. The server is stopped when the
+// test completes.
+func NewServer(tb testing.TB, handler *rws.WSHandler, dispatcher *rws.Dispatcher) *Server {
+	tb.Helper()
+
+	if handler == nil {
+		handler = &rws.WSHandler{}
+	}
+
+	s := &Server{Handler: handler, Broker: NewBroker(), tb: tb, clients: make(map[string]bool)}
+	handler.RedisPool = s.Broker.Pool()
+
+	s.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v, ok := s.auth.LoadAndDelete(r.Header.Get(authHeader)); ok {
+			r = r.WithContext(context.WithValue(r.Context(), sso.AuthContextKey, v.(sso.AuthData)))
+		}
+
+		handler.ServeWS(dispatcher, w, r)
+	}))
+	s.URL = "ws" + strings.TrimPrefix(s.srv.URL, "http")
+
+	tb.Cleanup(s.Close)
+	return s
+}
+
+// Close stops the server
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Connect opens a new websocket connection authenticated with the provided
+// auth data, and waits for the server to register the client
+func (s *Server) Connect(authData sso.AuthData) *Conn {
+	s.tb.Helper()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := uuid.New().String()
+	s.auth.Store(key, authData)
+	header := http.Header{}
+	header.Set(authHeader, key)
+
+	ws, _, err := websocket.DefaultDialer.Dial(s.URL, header)
+	if err != nil {
+		s.tb.Fatalf("rwstest: connecting: %v", err)
+	}
+
+	id := s.waitClient()
+	if id == "" {
+		ws.Close()
+		s.tb.Fatalf("rwstest: client not registered within %v", Timeout)
+	}
+
+	c := &Conn{ID: id, tb: s.tb, server: s, ws: ws, messages: make(chan rwsclient.Message, 256)}
+	go c.read()
+
+	s.tb.Cleanup(c.Close)
+	return c
+}
+
+// waitClient waits for a new client inbox to be subscribed and returns the
+// client ID
+func (s *Server) waitClient() string {
+	b := s.Broker
+	deadline := time.Now().Add(Timeout)
+	timer := time.AfterFunc(Timeout, func() {
+		b.mu.Lock()
+		b.cond.Broadcast()
+		b.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for time.Now().Before(deadline) {
+		for _, ch := range b.inboxes("client:") {
+			id := strings.TrimPrefix(ch, "client:")
+			if !s.clients[id] {
+				s.clients[id] = true
+				return id
+			}
+		}
+
+		b.cond.Wait()
+	}
+
+	return ""
+}
+
+// Publish publishes the value, encoded as JSON, to the topic
+func (s *Server) Publish(topic string, v interface{}) int {
+	s.tb.Helper()
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		s.tb.Fatalf("rwstest: encoding message: %v", err)
+	}
+
+	return s.Broker.Publish(topic, data)
+}
+
+// Conn is a scripted websocket client
+type Conn struct {
+	// ID assigned by the server to the client
+	ID string
+
+	tb       testing.TB
+	server   *Server
+	ws       *websocket.Conn
+	messages chan rwsclient.Message
+	err      error
+	wmu      sync.Mutex
+	once     sync.Once
+}
+
+// read pumps the received messages into the queue
+func (c *Conn) read() {
+	defer close(c.messages)
+
+	for {
+		_, data, err := c.ws.ReadMessage()
+		if err != nil {
+			c.err = err
+			return
+		}
+
+		// the server may pack several messages in a single frame
+		dec := json.NewDecoder(bytes.NewReader(data))
+		for dec.More() {
+			var msg rwsclient.Message
+			if err := dec.Decode(&msg); err != nil {
+				break
+			}
+
+			c.messages <- msg
+		}
+	}
+}
+
+// Close closes the connection
+func (c *Conn) Close() {
+	c.once.Do(func() {
+		c.wmu.Lock()
+		msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		c.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(Timeout))
+		c.wmu.Unlock()
+		c.ws.Close()
+	})
+}
+
+// Send sends the value, encoded as JSON, to the server
+func (c *Conn) Send(v interface{}) {
+	c.tb.Helper()
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if err := c.ws.WriteJSON(v); err != nil {
+		c.tb.Fatalf("rwstest: sending message: %v", err)
+	}
+}
+
+// Request sends a message of the provided type with the additional fields
+func (c *Conn) Request(t string, fields map[string]interface{}) {
+	c.tb.Helper()
+
+	m := make(map[string]interface{}, len(fields)+1)
+	for k, v := range fields {
+		m[k] = v
+	}
+	m["type"] = t
+	c.Send(m)
+}
+
+// Push publishes the value, encoded as JSON, to the client inbox
+func (c *Conn) Push(v interface{}) {
+	c.tb.Helper()
+	c.server.Publish("client:"+c.ID, v)
+}
+
+// Next waits for the next message
+func (c *Conn) Next() rwsclient.Message {
+	c.tb.Helper()
+
+	select {
+	case msg, ok := <-c.messages:
+		if !ok {
+			c.tb.Fatalf("rwstest: connection closed while waiting for a message")
+		}
+		return msg
+	case <-time.After(Timeout):
+		c.tb.Fatalf("rwstest: no message received within %v", Timeout)
+	}
+
+	return nil
+}
+
+// Expect waits for the next messages and checks they have the provided types,
+// in order
+func (c *Conn) Expect(types ...string) []rwsclient.Message {
+	c.tb.Helper()
+
+	msgs := make([]rwsclient.Message, 0, len(types))
+	for i, t := range types {
+		msg := c.Next()
+		if msg.Type() != t {
+			c.tb.Fatalf("rwstest: message %d has type %q, expected %q: %v", i, msg.Type(), t, msg)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs
+}
+
+// ExpectNone checks no message is received within the provided duration
+func (c *Conn) ExpectNone(d time.Duration) {
+	c.tb.Helper()
+
+	select {
+	case msg, ok := <-c.messages:
+		if ok {
+			c.tb.Fatalf("rwstest: unexpected message: %v", msg)
+		}
+	case <-time.After(d):
+	}
+}
+
+// ExpectClosed waits for the server to close the connection and returns the
+// close code
+func (c *Conn) ExpectClosed() int {
+	c.tb.Helper()
+
+	timer := time.NewTimer(Timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case _, ok := <-c.messages:
+			if ok {
+				continue
+			}
+
+			if ce, ok := c.err.(*websocket.CloseError); ok {
+				return ce.Code
+			}
+			return websocket.CloseAbnormalClosure
+		case <-timer.C:
+			c.tb.Fatalf("rwstest: connection not closed within %v", Timeout)
+			return 0
+		}
+	}
+}
+
+// WaitSubscribed waits for the client to be subscribed to the topic
+func (c *Conn) WaitSubscribed(topic string) {
+	c.tb.Helper()
+
+	deadline := time.Now().Add(Timeout)
+	for !c.server.Broker.Subscribed("client:"+c.ID, topic) {
+		if time.Now().After(deadline) {
+			c.tb.Fatalf("rwstest: client not subscribed to %s within %v", topic, Timeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,225 @@
+package rwstest_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lucalattore/goat/rws"
+	"github.com/lucalattore/goat/rwsclient"
+	"github.com/lucalattore/goat/rwstest"
+	"github.com/lucalattore/goat/sso"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// token returns a signed JWT carrying the claims
+func token(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte("rwstest")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func newDispatcher() *rws.Dispatcher {
+	d := rws.NewDispatcher()
+	d.HandleFunc("echo", func(c *rws.Client, r *map[string]interface{}) interface{} {
+		reply := rws.NewReply("echo", "")
+		reply["text"] = (*r)["text"]
+		return reply
+	})
+
+	topics := &rws.WSChannelParams{TopicPrefix: "news"}
+	d.HandleFunc("subscribe", topics.Subscribe)
+	d.HandleFunc("unsubscribe", topics.Unsubscribe)
+	return d
+}
+
+func TestEcho(t *testing.T) {
+	s := rwstest.NewServer(t, nil, newDispatcher())
+	c := s.Connect(sso.AuthData{})
+
+	c.Request("echo", map[string]interface{}{"text": "hello", "correlationId": "42"})
+	msg := c.Expect("echo")[0]
+	if msg["text"] != "hello" || msg["correlationId"] != "42" {
+		t.Fatalf("unexpected reply %v", msg)
+	}
+
+	c.Request("missing", nil)
+	if msg := c.Expect("error")[0]; msg["code"] != "400" {
+		t.Fatalf("unexpected error %v", msg)
+	}
+}
+
+func TestSubscribePublish(t *testing.T) {
+	s := rwstest.NewServer(t, &rws.WSHandler{TagTopic: true}, newDispatcher())
+	c := s.Connect(sso.AuthData{})
+	other := s.Connect(sso.AuthData{})
+
+	c.Request("subscribe", map[string]interface{}{"topic": "news:sport"})
+	c.WaitSubscribed("news:sport")
+
+	if n := s.Publish("news:sport", map[string]interface{}{"type": "article"}); n != 1 {
+		t.Fatalf("published to %d clients, expected 1", n)
+	}
+
+	if msg := c.Expect("article")[0]; msg.Topic() != "news:sport" {
+		t.Fatalf("message not tagged with the topic: %v", msg)
+	}
+	other.ExpectNone(50 * time.Millisecond)
+}
+
+func TestPush(t *testing.T) {
+	s := rwstest.NewServer(t, nil, newDispatcher())
+	c := s.Connect(sso.AuthData{})
+	other := s.Connect(sso.AuthData{})
+
+	c.Push(map[string]interface{}{"type": "direct"})
+	c.Expect("direct")
+	other.ExpectNone(50 * time.Millisecond)
+}
+
+func TestAuthenticationExpired(t *testing.T) {
+	handler := &rws.WSHandler{Auth: &sso.AuthParams{}, ReauthNotice: 900 * time.Millisecond}
+	s := rwstest.NewServer(t, handler, newDispatcher())
+
+	exp := time.Now().Add(time.Second).Truncate(time.Second).Add(time.Second)
+	c := s.Connect(sso.AuthData{Claims: map[string]interface{}{"sub": "alice", "exp": float64(exp.Unix())}})
+
+	c.Expect("reauth_required")
+	if code := c.ExpectClosed(); code != websocket.ClosePolicyViolation {
+		t.Fatalf("closed with code %d, expected %d", code, websocket.ClosePolicyViolation)
+	}
+}
+
+func TestReauthenticateMissingToken(t *testing.T) {
+	handler := &rws.WSHandler{Auth: &sso.AuthParams{}}
+	s := rwstest.NewServer(t, handler, newDispatcher())
+	c := s.Connect(sso.AuthData{Claims: map[string]interface{}{"sub": "alice"}})
+
+	c.Request("auth", nil)
+	if msg := c.Expect("error")[0]; msg["code"] != "400" {
+		t.Fatalf("unexpected reply %v", msg)
+	}
+}
+
+func TestReauthenticate(t *testing.T) {
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	later := float64(time.Now().Add(2 * time.Hour).Unix())
+
+	tests := []struct {
+		name   string
+		auth   map[string]interface{}
+		claims map[string]interface{}
+		code   string
+	}{
+		{"same subject", map[string]interface{}{"sub": "alice", "exp": exp}, map[string]interface{}{"sub": "alice", "exp": later}, ""},
+		{"non-expiring connection", map[string]interface{}{"sub": "alice"}, map[string]interface{}{"sub": "alice"}, ""},
+		{"different subject", map[string]interface{}{"sub": "alice", "exp": exp}, map[string]interface{}{"sub": "mallory", "exp": later}, "403"},
+		{"connection without subject", map[string]interface{}{}, map[string]interface{}{"sub": "mallory", "exp": later}, "403"},
+		{"token without subject", map[string]interface{}{"sub": "alice", "exp": exp}, map[string]interface{}{"exp": later}, "403"},
+		{"token without expiration", map[string]interface{}{"sub": "alice", "exp": exp}, map[string]interface{}{"sub": "alice"}, "403"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := rwstest.NewServer(t, &rws.WSHandler{Auth: &sso.AuthParams{}}, newDispatcher())
+			c := s.Connect(sso.AuthData{Claims: tt.auth})
+
+			c.Request("auth", map[string]interface{}{"token": token(t, tt.claims)})
+			if tt.code == "" {
+				c.Expect("auth")
+				return
+			}
+
+			if msg := c.Expect("error")[0]; msg["code"] != tt.code {
+				t.Fatalf("unexpected reply %v", msg)
+			}
+		})
+	}
+}
+
+func TestClient(t *testing.T) {
+	s := rwstest.NewServer(t, &rws.WSHandler{TagTopic: true}, newDispatcher())
+
+	ctx, cancel := context.WithTimeout(context.Background(), rwstest.Timeout)
+	defer cancel()
+
+	client, err := rwsclient.Dial(ctx, s.URL, rwsclient.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var reply struct{ Text string }
+	if err := client.Request(ctx, "echo", map[string]string{"text": "hi"}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Text != "hi" {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+
+	err = client.Request(ctx, "missing", nil, nil)
+	if e, ok := err.(*rwsclient.Error); !ok || e.Code != "400" {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	received := make(chan rwsclient.Message, 1)
+	if err := client.Subscribe("news:tech", func(msg rwsclient.Message) { received <- msg }); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(rwstest.Timeout)
+	for s.Publish("news:tech", map[string]interface{}{"type": "article"}) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("client not subscribed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case msg := <-received:
+		if msg.Type() != "article" {
+			t.Fatalf("unexpected message %v", msg)
+		}
+	case <-time.After(rwstest.Timeout):
+		t.Fatal("message not received")
+	}
+}
+
+func TestMetricsQueueDepth(t *testing.T) {
+	metrics := rws.NewMetrics()
+	s := rwstest.NewServer(t, &rws.WSHandler{Metrics: metrics}, newDispatcher())
+	c := s.Connect(sso.AuthData{})
+
+	for i := 0; i < 50; i++ {
+		c.Push(map[string]interface{}{"type": "direct"})
+	}
+	c.Close()
+
+	deadline := time.Now().Add(rwstest.Timeout)
+	for {
+		var b strings.Builder
+		metrics.WriteTo(&b)
+		out := b.String()
+		if strings.Contains(out, "\nrws_outbound_queue_depth 0\n") &&
+			strings.Contains(out, "\nrws_inbound_queue_depth 0\n") &&
+			strings.Contains(out, `rws_connected_clients{transport="ws"} 0`) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queue depth not reset after disconnect:\n%s", out)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,169 @@
+package rwstest_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/lucalattore/goat/rws"
+	"github.com/lucalattore/goat/rwstest"
+)
+
+// sseServer serves the SSE transport of the handler, backed by the pool
+func sseServer(t *testing.T, pool *redis.Pool) *httptest.Server {
+	h := &rws.WSHandler{RedisPool: pool}
+	d := newDispatcher()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) { h.ServeSSE(d, w, r) })
+	mux.HandleFunc("/request", h.ServeSSERequest)
+
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// sseStream is an event stream opened on the server
+type sseStream struct {
+	t      *testing.T
+	cancel context.CancelFunc
+	events chan map[string]interface{}
+}
+
+// openStream opens an event stream, returning it with the client ID announced
+// by its first event
+func openStream(t *testing.T, url string) (*sseStream, string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &sseStream{t: t, cancel: cancel, events: make(chan map[string]interface{}, 16)}
+	go func() {
+		defer res.Body.Close()
+		defer close(s.events)
+
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+
+			var msg map[string]interface{}
+			if json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &msg) == nil {
+				s.events <- msg
+			}
+		}
+	}()
+
+	msg := s.expect("connected")
+	return s, msg["id"].(string)
+}
+
+// expect waits for the next event, which must be of type t
+func (s *sseStream) expect(t string) map[string]interface{} {
+	s.t.Helper()
+
+	select {
+	case msg, ok := <-s.events:
+		if !ok {
+			s.t.Fatalf("event stream closed while waiting for %s", t)
+		}
+		if msg["type"] != t {
+			s.t.Fatalf("received %v, expected %s", msg, t)
+		}
+		return msg
+	case <-time.After(rwstest.Timeout):
+		s.t.Fatalf("timed out waiting for %s", t)
+		return nil
+	}
+}
+
+// waitListening waits until the listener of the client is subscribed or, if not
+// listening, unsubscribed from its inbox
+func waitListening(t *testing.T, broker *rwstest.Broker, id string, listening bool) {
+	t.Helper()
+
+	inbox := "client:" + id
+	deadline := time.Now().Add(rwstest.Timeout)
+	for broker.Subscribed(inbox, inbox) != listening {
+		if time.Now().After(deadline) {
+			t.Fatalf("client %s listening: %v, expected %v", id, !listening, listening)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSSE(t *testing.T) {
+	broker := rwstest.NewBroker()
+	s := sseServer(t, broker.Pool())
+
+	stream, id := openStream(t, s.URL)
+	waitListening(t, broker, id, true)
+
+	res, err := http.Post(s.URL+"/request?client="+id, "application/json", strings.NewReader(`{"type":"echo","text":"hi"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("request replied %d", res.StatusCode)
+	}
+	if msg := stream.expect("echo"); msg["text"] != "hi" {
+		t.Fatalf("unexpected reply %v", msg)
+	}
+
+	broker.Publish("client:"+id, []byte(`{"type":"direct"}`))
+	stream.expect("direct")
+
+	stream.cancel()
+	waitListening(t, broker, id, false)
+
+	res, err = http.Post(s.URL+"/request?client="+id, "application/json", strings.NewReader(`{"type":"echo"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("request to a disconnected client replied %d", res.StatusCode)
+	}
+}
+
+func TestSSEDisconnectBeforeListening(t *testing.T) {
+	broker := rwstest.NewBroker()
+	pool := broker.Pool()
+	dial := pool.Dial
+	pool.Dial = func() (redis.Conn, error) {
+		time.Sleep(20 * time.Millisecond)
+		return dial()
+	}
+	s := sseServer(t, pool)
+
+	// the streams end while their listener is still connecting to Redis, which
+	// must not leak once the client is gone
+	ids := make([]string, 0, 20)
+	for i := 0; i < 20; i++ {
+		stream, id := openStream(t, s.URL)
+		stream.cancel()
+		ids = append(ids, id)
+	}
+
+	// give the listeners the time to subscribe, if they were to do it late
+	time.Sleep(100 * time.Millisecond)
+	for _, id := range ids {
+		waitListening(t, broker, id, false)
+	}
+}
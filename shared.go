@@ -0,0 +1,177 @@
+package goat
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sync"
+)
+
+// pools opens the tenant database connections, sharing a single connection among
+// the tenants mapped to schemas of the same database
+type pools struct {
+	mu     sync.Mutex
+	shared map[string]*sharedPool
+}
+
+// sharedPool is a database connection shared by several tenants
+type sharedPool struct {
+	db       *sql.DB
+	replicas *replicaSet
+	refs     int
+}
+
+// open opens the tenant, reusing the shared database connection if any. Checkers
+// counts the health checkers keeping the health of the replicas.
+func (p *pools) open(t Tenant, checkers *int32) (*TenantHandle, error) {
+	if !t.shared() {
+		return openTenant(t, checkers)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := t.connectionKey()
+	sp, ok := p.shared[key]
+	if !ok {
+		th, err := openTenant(t, checkers)
+		if err != nil {
+			return nil, err
+		}
+
+		if p.shared == nil {
+			p.shared = make(map[string]*sharedPool)
+		}
+		sp = &sharedPool{db: th.pool(), replicas: th.replicas}
+		p.shared[key] = sp
+	}
+
+	sp.refs++
+	return newHandle(t, sp.db, sp.replicas), nil
+}
+
+// close closes the tenant database connection, unless other tenants still share it
+func (p *pools) close(th *TenantHandle) error {
+	if !th.Config.shared() {
+		return th.close()
+	}
+
+	p.mu.Lock()
+	key := th.Config.connectionKey()
+	sp, ok := p.shared[key]
+	if ok && sp.db == th.pool() {
+		sp.refs--
+		if sp.refs > 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		delete(p.shared, key)
+	}
+	p.mu.Unlock()
+
+	return th.close()
+}
+
+// execer is implemented by connections and transactions
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// scope applies the tenant settings, the schema search path and the tenant id, to a
+// connection or, if local, to the current transaction only
+func (th *TenantHandle) scope(ctx context.Context, conn execer, local bool) error {
+	if th.Config.Schema != "" {
+		set := "SET search_path TO "
+		if local {
+			set = "SET LOCAL search_path TO "
+		}
+
+		if _, err := conn.ExecContext(ctx, set+QuoteIdentifier(th.Config.Schema)); err != nil {
+			return err
+		}
+	}
+
+	if th.Config.TenantID != "" {
+		_, err := conn.ExecContext(ctx, "SELECT set_config($1, $2, $3)",
+			th.Config.tenantSetting(), th.Config.TenantID, local)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unscope resets the tenant settings applied to a connection
+func (th *TenantHandle) unscope(ctx context.Context, conn execer) error {
+	if th.Config.Schema != "" {
+		if _, err := conn.ExecContext(ctx, "RESET search_path"); err != nil {
+			return err
+		}
+	}
+
+	if th.Config.TenantID != "" {
+		_, err := conn.ExecContext(ctx, "SELECT set_config($1, '', false)", th.Config.tenantSetting())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// TenantConn is a database connection checked out for a tenant. Close resets the
+// tenant settings before returning the connection to the pool.
+type TenantConn struct {
+	*sql.Conn
+	th *TenantHandle
+}
+
+// Close resets the connection and returns it to the pool. A connection that cannot
+// be reset is discarded, so that the tenant settings never leak to its next user.
+func (c *TenantConn) Close() error {
+	if c.th.Config.shared() {
+		if err := c.th.unscope(context.Background(), c.Conn); err != nil {
+			c.Conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+			return err
+		}
+	}
+
+	return c.Conn.Close()
+}
+
+// Conn checks out a connection of the tenant, which must be closed to return it to
+// the pool. If the tenant shares the database, the search path of the connection is
+// set to the tenant schema and the tenant id is assigned until it is closed.
+func (th *TenantHandle) Conn(ctx context.Context) (*TenantConn, error) {
+	conn, err := th.pool().Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if th.Config.shared() {
+		if err := th.scope(ctx, conn, false); err != nil {
+			// the connection may be partially scoped
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+			return nil, err
+		}
+	}
+
+	return &TenantConn{Conn: conn, th: th}, nil
+}
+
+// WithTransaction runs the `TxFn` in a transaction of the tenant as
+// WithTransactionContext does. If the tenant shares the database, the search path of
+// the transaction is set to the tenant schema and the tenant id is assigned at the
+// start of the transaction: both are local to the transaction, so they cannot leak
+// to the next user of the connection. An ambient transaction is joined only if it
+// belongs to the same tenant.
+func (th *TenantHandle) WithTransaction(ctx context.Context, opts *sql.TxOptions, fn TxFn) error {
+	if !th.Config.shared() {
+		return WithTransactionContext(ctx, th.pool(), opts, fn)
+	}
+
+	return withTenantTransaction(ctx, th.pool(), th.Name, func(ctx context.Context, tx *sql.Tx) error {
+		return th.scope(ctx, tx, true)
+	}, opts, fn)
+}
@@ -0,0 +1,163 @@
+package goat
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"gopkg.in/yaml.v2"
+)
+
+// TenantSource provides the configuration of the tenants
+type TenantSource interface {
+	LoadTenants(ctx context.Context) ([]Tenant, error)
+}
+
+// RuleSource is implemented by the tenant sources providing the domain rules too.
+// The rules of a source that does not implement it are left unchanged by
+// MDB.Refresh.
+type RuleSource interface {
+	LoadRules(ctx context.Context) ([]DomainRule, error)
+}
+
+// LoadTenants returns the configured tenants
+func (m Multitenant) LoadTenants(ctx context.Context) ([]Tenant, error) {
+	return m.Tenants, nil
+}
+
+// LoadRules returns the configured domain rules
+func (m Multitenant) LoadRules(ctx context.Context) ([]DomainRule, error) {
+	return m.Rules, nil
+}
+
+// FileSource provides the tenants configured in a YAML file, read again at every load
+type FileSource string
+
+// LoadTenants reads the tenants from the file
+func (f FileSource) LoadTenants(ctx context.Context) ([]Tenant, error) {
+	cfg, err := LoadMultitenant(string(f))
+	return cfg.Tenants, err
+}
+
+// LoadRules reads the domain rules from the file
+func (f FileSource) LoadRules(ctx context.Context) ([]DomainRule, error) {
+	cfg, err := LoadMultitenant(string(f))
+	return cfg.Rules, err
+}
+
+// SQLSource provides the tenants stored in a control database table, one row per
+// tenant. Domains are stored as a comma separated list.
+type SQLSource struct {
+	DB *sql.DB
+
+	// Name of the tenants table, "tenants" if not set
+	Table string
+}
+
+// TableName returns the name of the tenants table
+func (s SQLSource) TableName() string {
+	if s.Table == "" {
+		return "tenants"
+	}
+
+	return s.Table
+}
+
+// Schema returns the statement creating the tenants table
+func (s SQLSource) Schema() string {
+	return "CREATE TABLE IF NOT EXISTS " + s.TableName() + ` (
+	name TEXT PRIMARY KEY,
+	url TEXT NOT NULL,
+	domains TEXT NOT NULL DEFAULT '',
+	max_connections INTEGER NOT NULL DEFAULT 0,
+	idle_connections INTEGER NOT NULL DEFAULT 0,
+	is_default BOOLEAN NOT NULL DEFAULT false
+);
+`
+}
+
+// tenantRow is a row of the tenants table
+type tenantRow struct {
+	Name            string `db:"name"`
+	URL             string `db:"url"`
+	Domains         string `db:"domains"`
+	MaxConnections  int    `db:"max_connections"`
+	IdleConnections int    `db:"idle_connections"`
+	Default         bool   `db:"is_default"`
+}
+
+// LoadTenants queries the tenants table
+func (s SQLSource) LoadTenants(ctx context.Context) ([]Tenant, error) {
+	rows, err := QueryAll[tenantRow](ctx, s.DB, "SELECT name, url, domains, max_connections, idle_connections, is_default FROM "+
+		s.TableName()+" ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+
+	tenants := make([]Tenant, 0, len(rows))
+	for _, r := range rows {
+		tenants = append(tenants, Tenant{
+			Name:            r.Name,
+			URL:             r.URL,
+			Domains:         splitList(r.Domains),
+			MaxConnections:  r.MaxConnections,
+			IdleConnections: r.IdleConnections,
+			Default:         r.Default,
+		})
+	}
+	return tenants, nil
+}
+
+// splitList splits a comma separated list, skipping empty items
+func splitList(s string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// RedisSource provides the tenants stored in a Redis hash, whose fields are the
+// tenant names and values the tenant configurations in JSON or YAML, with the
+// same keys of the configuration file
+type RedisSource struct {
+	Pool *redis.Pool
+
+	// Key of the hash, "tenants" if not set
+	Key string
+}
+
+// LoadTenants reads the tenants from the hash
+func (s RedisSource) LoadTenants(ctx context.Context) ([]Tenant, error) {
+	key := s.Key
+	if key == "" {
+		key = "tenants"
+	}
+
+	rconn, err := s.Pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rconn.Close()
+
+	values, err := redis.StringMap(rconn.Do("HGETALL", key))
+	if err != nil {
+		return nil, err
+	}
+
+	tenants := make([]Tenant, 0, len(values))
+	for name, v := range values {
+		var t Tenant
+		if err := yaml.Unmarshal([]byte(v), &t); err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", name, err)
+		}
+
+		t.Name = name
+		tenants = append(tenants, t)
+	}
+	return tenants, nil
+}
@@ -9,6 +9,7 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/lucalattore/goat"
 	"gopkg.in/square/go-jose.v2/jwt"
@@ -42,6 +43,25 @@ func (a AuthData) PreferredUsername() string {
 	return ""
 }
 
+// Subject get the subject of the token
+func (a AuthData) Subject() string {
+	if sub, ok := a.Claims["sub"].(string); ok {
+		return sub
+	}
+
+	return ""
+}
+
+// ExpiresAt get the expiration time of the token. It returns the zero time
+// if the token does not expire
+func (a AuthData) ExpiresAt() time.Time {
+	if exp, ok := a.Claims["exp"].(float64); ok {
+		return time.Unix(int64(exp), 0)
+	}
+
+	return time.Time{}
+}
+
 // AuthMiddleware checks the authentication
 func (p AuthParams) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -67,35 +87,12 @@ func (p AuthParams) AuthMiddleware(next http.Handler) http.Handler {
 		} else {
 			log.Println("Found token:", token)
 
-			// decode JWT token without verifying the signature
-			tk, err := jwt.ParseSigned(token)
-			if err != nil {
-				http.Error(w, "Forbidden", http.StatusForbidden)
-				return
-			}
-
-			err = tk.UnsafeClaimsWithoutVerification(&authData.Claims)
+			var err error
+			authData, err = p.Authenticate(token)
 			if err != nil {
 				http.Error(w, "Forbidden", http.StatusForbidden)
 				return
 			}
-
-			log.Println("Got JWT:", authData.Claims, err)
-			if p.ValidationURL != "" {
-				clientID, ok := authData.Claims["client_id"].(string)
-				if !ok {
-					http.Error(w, "Forbidden", http.StatusForbidden)
-					return
-				}
-
-				profile, err := validateToken(p.ValidationURL, clientID, token)
-				if err != nil {
-					http.Error(w, "Forbidden", http.StatusForbidden)
-					return
-				}
-
-				authData.Profile = *profile
-			}
 		}
 
 		c := context.WithValue(r.Context(), AuthContextKey, authData)
@@ -105,6 +102,40 @@ func (p AuthParams) AuthMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// Authenticate decodes the JWT token and, when a validation URL is configured,
+// validates it against the SSO returning the related auth data
+func (p AuthParams) Authenticate(token string) (AuthData, error) {
+	authData := AuthData{Token: token}
+
+	// decode JWT token without verifying the signature
+	tk, err := jwt.ParseSigned(token)
+	if err != nil {
+		return authData, err
+	}
+
+	err = tk.UnsafeClaimsWithoutVerification(&authData.Claims)
+	if err != nil {
+		return authData, err
+	}
+
+	log.Println("Got JWT:", authData.Claims, err)
+	if p.ValidationURL != "" {
+		clientID, ok := authData.Claims["client_id"].(string)
+		if !ok {
+			return authData, errors.New("Missing client_id claim")
+		}
+
+		profile, err := validateToken(p.ValidationURL, clientID, token)
+		if err != nil {
+			return authData, err
+		}
+
+		authData.Profile = *profile
+	}
+
+	return authData, nil
+}
+
 func validateToken(url string, clientID string, token string) (*map[string]interface{}, error) {
 	req, err := http.NewRequest("GET", url+"?client_id="+clientID, nil)
 	if err != nil {
@@ -33,3 +33,9 @@ func EvaluateEnv(s string) string {
 
 	return s
 }
+
+// QuoteIdentifier quotes a SQL identifier, such as a schema or column name, so that
+// it can be safely embedded in a statement
+func QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,175 @@
+// Package tenancy resolves the tenant of HTTP requests against a goat.MDB and
+// stores it in the request context.
+package tenancy
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lucalattore/goat"
+	"github.com/lucalattore/goat/sso"
+)
+
+// TenantContextType is the type of tenant context key identifier
+type TenantContextType struct{}
+
+// TenantContextKey identifies the tenant in the request context
+var TenantContextKey = &TenantContextType{}
+
+// FromContext returns the tenant stored in the context by the middleware
+func FromContext(ctx context.Context) (*goat.TenantHandle, bool) {
+	t, ok := ctx.Value(TenantContextKey).(*goat.TenantHandle)
+	return t, ok
+}
+
+// DB returns the database connection of the tenant stored in the context, or nil if
+// there is none or the tenant shares the database with others: use WithTransaction
+// to scope the statements to such a tenant
+func DB(ctx context.Context) *sql.DB {
+	if t, ok := FromContext(ctx); ok {
+		return t.DB
+	}
+
+	return nil
+}
+
+// WithTransaction runs the `TxFn` in a transaction of the tenant stored in the
+// context, scoped to the tenant if it shares the database (see
+// goat.TenantHandle.WithTransaction)
+func WithTransaction(ctx context.Context, fn goat.TxFn) error {
+	t, ok := FromContext(ctx)
+	if !ok {
+		return goat.ErrUnknownTenant
+	}
+
+	return t.WithTransaction(ctx, nil, fn)
+}
+
+// Source extracts the tenant domain from a request
+type Source struct {
+	// Extract returns the domain or an empty string if not found
+	Extract func(r *http.Request) string
+
+	// Authority tells the domain identifies the server the request is sent to,
+	// so an unknown domain is reported as 421 Misdirected Request
+	Authority bool
+}
+
+// Host extracts the domain from the Host header, without the port
+func Host() Source {
+	return Source{Extract: func(r *http.Request) string { return stripPort(r.Host) }, Authority: true}
+}
+
+// ForwardedHost extracts the domain from the X-Forwarded-Host header set by proxies
+func ForwardedHost() Source {
+	return Source{Extract: func(r *http.Request) string {
+		h := strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Host"), ",")[0])
+		return stripPort(h)
+	}, Authority: true}
+}
+
+// Header extracts the domain from the provided request header
+func Header(name string) Source {
+	return Source{Extract: func(r *http.Request) string { return strings.TrimSpace(r.Header.Get(name)) }}
+}
+
+// PathSegment extracts the domain from the n-th segment (starting from 0) of the
+// request path, e.g. PathSegment(1) for /api/{tenant}/...
+func PathSegment(n int) Source {
+	return Source{Extract: func(r *http.Request) string {
+		segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if n < 0 || n >= len(segments) {
+			return ""
+		}
+		return segments[n]
+	}}
+}
+
+// Claim extracts the domain from the provided JWT claim of the authenticated user.
+// The sso middleware must run before the tenant one.
+func Claim(name string) Source {
+	return Source{Extract: func(r *http.Request) string {
+		authData, _ := r.Context().Value(sso.AuthContextKey).(sso.AuthData)
+		s, _ := authData.Claims[name].(string)
+		return s
+	}}
+}
+
+// Resolver resolves the tenant of the requests from the first source providing a
+// domain. Requests whose tenant cannot be resolved are rejected with 404 Not Found,
+// or 421 Misdirected Request when the domain comes from an authority source, and
+// requests for an unhealthy tenant with 503 Service Unavailable.
+type Resolver struct {
+	MDB     *goat.MDB
+	Sources []Source
+}
+
+// Resolve returns the tenant of the request, or the HTTP status to reply with
+func (rv *Resolver) Resolve(r *http.Request) (*goat.TenantHandle, int) {
+	for _, src := range rv.Sources {
+		domain := src.Extract(r)
+		if domain == "" {
+			continue
+		}
+
+		t, err := rv.MDB.Lookup(domain)
+		if err != nil {
+			log.Println(err)
+			if errors.Is(err, goat.ErrTenantUnavailable) {
+				return nil, http.StatusServiceUnavailable
+			}
+
+			if src.Authority {
+				return nil, http.StatusMisdirectedRequest
+			}
+			return nil, http.StatusNotFound
+		}
+
+		return t, http.StatusOK
+	}
+
+	return nil, http.StatusNotFound
+}
+
+// Middleware resolves the tenant and stores it in the request context
+func (rv *Resolver) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, status := rv.Resolve(r)
+		if t == nil {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+
+		c := context.WithValue(r.Context(), TenantContextKey, t)
+		next.ServeHTTP(w, r.WithContext(c))
+	})
+}
+
+// Gin resolves the tenant and stores it in the request context
+func (rv *Resolver) Gin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		t, status := rv.Resolve(c.Request)
+		if t == nil {
+			c.AbortWithStatus(status)
+			return
+		}
+
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), TenantContextKey, t))
+		c.Next()
+	}
+}
+
+// stripPort removes the port from a host
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+
+	return host
+}
@@ -1,6 +1,13 @@
 package goat
 
-import "database/sql"
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"sync/atomic"
+)
 
 // Transaction is an interface that models the standard transaction in
 // `database/sql`.
@@ -12,24 +19,235 @@ type Transaction interface {
 	Prepare(query string) (*sql.Stmt, error)
 	Query(query string, args ...interface{}) (*sql.Rows, error)
 	QueryRow(query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// HookRegistrar is implemented by the transactions created by goat, which run
+// callbacks once their outcome is known. Use OnCommit and OnRollback to register
+// them on a `Transaction`.
+type HookRegistrar interface {
+	// OnCommit registers a callback executed once the transaction is committed
+	OnCommit(fn func() error)
+
+	// OnRollback registers a callback executed once the transaction is rolled back
+	OnRollback(fn func() error)
+}
+
+// ErrNoHooks is returned when registering a callback on a transaction that was not
+// created by goat, e.g. a raw *sql.Tx
+var ErrNoHooks = errors.New("transaction does not support hooks")
+
+// OnCommit registers a callback executed once the transaction is committed. It
+// fails with ErrNoHooks if the transaction does not implement HookRegistrar.
+func OnCommit(tx Transaction, fn func() error) error {
+	hr, ok := tx.(HookRegistrar)
+	if !ok {
+		return ErrNoHooks
+	}
+
+	hr.OnCommit(fn)
+	return nil
+}
+
+// OnRollback registers a callback executed once the transaction is rolled back. It
+// fails with ErrNoHooks if the transaction does not implement HookRegistrar.
+func OnRollback(tx Transaction, fn func() error) error {
+	hr, ok := tx.(HookRegistrar)
+	if !ok {
+		return ErrNoHooks
+	}
+
+	hr.OnRollback(fn)
+	return nil
 }
 
 // A TxFn is a function that will be called with an initialized `Transaction` object
 // that can be used for executing statements and queries against a database.
 type TxFn func(Transaction) error
 
+// HookError reports the failures of the callbacks registered with OnCommit or
+// OnRollback. Err is the outcome of the transaction itself: nil means the
+// transaction was committed.
+//
+// A transaction returns a HookError only if it failed, wrapping its error, so
+// that a committed transaction is never reported as failed: the failures of the
+// callbacks of a committed transaction are passed to the handler set with
+// ContextWithHookErrorHandler, or logged if there is none.
+type HookError struct {
+	Err   error
+	Hooks []error
+}
+
+func (e *HookError) Error() string {
+	msg := strconv.Itoa(len(e.Hooks)) + " transaction hook(s) failed: " + e.Hooks[0].Error()
+	if e.Err != nil {
+		msg = e.Err.Error() + "; " + msg
+	}
+	return msg
+}
+
+// Unwrap returns the outcome of the transaction
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// hookErrorKey identifies the hook error handler in a context
+type hookErrorKey struct{}
+
+// ContextWithHookErrorHandler returns a copy of the context carrying the handler
+// of the failures of the OnCommit callbacks of the transactions created with it,
+// which are committed anyway. Without a handler the failures are logged.
+func ContextWithHookErrorHandler(ctx context.Context, fn func(*HookError)) context.Context {
+	return context.WithValue(ctx, hookErrorKey{}, fn)
+}
+
+// txn is the `Transaction` created by goat, bound to the database it belongs to and,
+// on a database shared by several tenants, to the tenant it was set up for.
+// Nested scopes share the underlying transaction and keep their own callbacks
+// until the outcome of the scope is known.
+type txn struct {
+	*sql.Tx
+	db         *sql.DB
+	tenant     string
+	onCommit   []func() error
+	onRollback []func() error
+
+	// onHookError handles the failures of the OnCommit callbacks, if set
+	onHookError func(*HookError)
+}
+
+// OnCommit registers a callback executed once the transaction is committed
+func (tx *txn) OnCommit(fn func() error) {
+	tx.onCommit = append(tx.onCommit, fn)
+}
+
+// OnRollback registers a callback executed once the transaction is rolled back
+func (tx *txn) OnRollback(fn func() error) {
+	tx.onRollback = append(tx.onRollback, fn)
+}
+
+// nested creates the handle of a nested scope
+func (tx *txn) nested() *txn {
+	return &txn{Tx: tx.Tx, db: tx.db, tenant: tx.tenant, onHookError: tx.onHookError}
+}
+
+// release hands the callbacks of a nested scope over to the enclosing one, since
+// they depend on its outcome now
+func (tx *txn) release(parent *txn) {
+	parent.onCommit = append(parent.onCommit, tx.onCommit...)
+	parent.onRollback = append(parent.onRollback, tx.onRollback...)
+}
+
+// complete runs the callbacks matching the outcome of the transaction, returning
+// the outcome itself, wrapped in a HookError if the transaction failed and any
+// callback failed too. The failures of the callbacks of a committed transaction
+// go to the hook error handler of the transaction.
+func (tx *txn) complete(err error) error {
+	hooks := tx.onCommit
+	if err != nil {
+		hooks = tx.onRollback
+	}
+
+	var errs []error
+	for _, fn := range hooks {
+		if herr := fn(); herr != nil {
+			errs = append(errs, herr)
+		}
+	}
+
+	if len(errs) == 0 {
+		return err
+	}
+
+	if err == nil {
+		herr := &HookError{Hooks: errs}
+		if tx.onHookError != nil {
+			tx.onHookError(herr)
+		} else {
+			log.Println(herr)
+		}
+		return nil
+	}
+
+	return &HookError{Err: err, Hooks: errs}
+}
+
+// txContextKey identifies the ambient transaction in a context
+type txContextKey struct{}
+
+// savepointSeq generates unique savepoint names
+var savepointSeq uint64
+
+// errPanic is the outcome of a transaction aborted by a panic
+var errPanic = errors.New("goat: transaction aborted by panic")
+
+// ContextWithTransaction returns a copy of the context carrying the transaction. Any
+// `WithTransactionContext` called with that context against the same database runs in
+// a savepoint of the transaction instead of opening a new one.
+func ContextWithTransaction(ctx context.Context, tx Transaction) context.Context {
+	return context.WithValue(ctx, txContextKey{}, tx)
+}
+
+// TransactionFromContext returns the transaction carried by the context, if any
+func TransactionFromContext(ctx context.Context) Transaction {
+	tx, _ := ctx.Value(txContextKey{}).(Transaction)
+	return tx
+}
+
+// ambient returns the transaction carried by the context if it was created by goat
+// against the provided database for the provided tenant
+func ambient(ctx context.Context, db *sql.DB, tenant string) *txn {
+	if tx, ok := ctx.Value(txContextKey{}).(*txn); ok && tx.db == db && tx.tenant == tenant {
+		return tx
+	}
+
+	return nil
+}
+
 // WithTransaction creates a new transaction and handles rollback/commit based on the
 // error object returned by the `TxFn`
-func WithTransaction(db *sql.DB, fn TxFn) (err error) {
-	tx, err := db.Begin()
+func WithTransaction(db *sql.DB, fn TxFn) error {
+	return WithTransactionContext(context.Background(), db, nil, fn)
+}
+
+// WithTransactionContext creates a new transaction bound to the context, using the
+// provided options (isolation level, read-only), and handles rollback/commit based on
+// the error object returned by the `TxFn`. If the context is canceled before the
+// transaction completes, the transaction is rolled back.
+//
+// If the context carries a transaction against the same database (see
+// `ContextWithTransaction`) the `TxFn` runs in a savepoint of that transaction and the
+// options are ignored.
+func WithTransactionContext(ctx context.Context, db *sql.DB, opts *sql.TxOptions, fn TxFn) error {
+	return withTenantTransaction(ctx, db, "", nil, opts, fn)
+}
+
+// withTenantTransaction runs the `TxFn` as WithTransactionContext does in a transaction
+// bound to the tenant, on a database shared by several tenants. The setup function,
+// if any, runs at the start of the transaction to scope it to the tenant. An ambient
+// transaction is joined only if it is bound to the same tenant.
+func withTenantTransaction(ctx context.Context, db *sql.DB, tenant string,
+	setup func(context.Context, *sql.Tx) error, opts *sql.TxOptions, fn TxFn) (err error) {
+	if tx := ambient(ctx, db, tenant); tx != nil {
+		return WithNestedTransaction(ctx, tx, fn)
+	}
+
+	sqltx, err := db.BeginTx(ctx, opts)
 	if err != nil {
 		return
 	}
 
+	tx := &txn{Tx: sqltx, db: db, tenant: tenant}
+	tx.onHookError, _ = ctx.Value(hookErrorKey{}).(func(*HookError))
+
 	defer func() {
 		if p := recover(); p != nil {
 			// a panic occurred, rollback and repanic
 			tx.Rollback()
+			tx.complete(errPanic)
 			panic(p)
 		} else if err != nil {
 			// something went wrong, rollback
@@ -38,8 +256,83 @@ func WithTransaction(db *sql.DB, fn TxFn) (err error) {
 			// all good, commit
 			err = tx.Commit()
 		}
+		err = tx.complete(err)
 	}()
 
+	if setup != nil {
+		if err = setup(ctx, sqltx); err != nil {
+			return
+		}
+	}
+
 	err = fn(tx)
 	return err
 }
+
+// WithNestedTransaction runs the `TxFn` in a savepoint of the provided transaction.
+// The savepoint is released if the `TxFn` succeeds and rolled back if it fails or
+// panics, leaving the enclosing transaction usable in both cases.
+//
+// Callbacks registered by the `TxFn` with OnRollback run as soon as the savepoint is
+// rolled back; otherwise they are bound to the outcome of the enclosing transaction.
+func WithNestedTransaction(ctx context.Context, tx Transaction, fn TxFn) (err error) {
+	name := "goat_sp_" + strconv.FormatUint(atomic.AddUint64(&savepointSeq, 1), 10)
+	if _, err = tx.ExecContext(ctx, "SAVEPOINT "+name); err != nil {
+		return
+	}
+
+	// callbacks are tracked per scope only by goat transactions
+	scope := tx
+	parent, _ := tx.(*txn)
+	var child *txn
+	if parent != nil {
+		child = parent.nested()
+		scope = child
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			// a panic occurred, rollback to the savepoint and repanic
+			tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name)
+			if child != nil {
+				child.complete(errPanic)
+			}
+			panic(p)
+		} else if err != nil {
+			// something went wrong, rollback to the savepoint
+			tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name)
+			if child != nil {
+				err = child.complete(err)
+			}
+		} else if _, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT "+name); err != nil {
+			// the savepoint cannot be released, the enclosing transaction is aborted
+			if child != nil {
+				err = child.complete(err)
+			}
+		} else if child != nil {
+			// all good, the callbacks follow the enclosing transaction
+			child.release(parent)
+		}
+	}()
+
+	err = fn(scope)
+	return err
+}
+
+// InTx runs the function in a new transaction as WithTransactionContext does and
+// returns its result. The zero value is returned if the transaction is rolled back.
+func InTx[T any](ctx context.Context, db *sql.DB, fn func(Transaction) (T, error)) (T, error) {
+	var result T
+	err := WithTransactionContext(ctx, db, nil, func(tx Transaction) error {
+		var err error
+		result, err = fn(tx)
+		return err
+	})
+
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+
+	return result, nil
+}
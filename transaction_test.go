@@ -0,0 +1,75 @@
+package goat
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+// the transactions of database/sql can be passed as a Transaction
+var _ Transaction = (*sql.Tx)(nil)
+
+func TestHooksRequireGoatTransaction(t *testing.T) {
+	db, err := sql.Open("goat-flaky", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if err := OnCommit(tx, func() error { return nil }); !errors.Is(err, ErrNoHooks) {
+		t.Fatalf("expected ErrNoHooks, got %v", err)
+	}
+	if err := OnRollback(tx, func() error { return nil }); !errors.Is(err, ErrNoHooks) {
+		t.Fatalf("expected ErrNoHooks, got %v", err)
+	}
+}
+
+func TestCommitHookFailure(t *testing.T) {
+	db, err := sql.Open("goat-flaky", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var reported *HookError
+	ctx := ContextWithHookErrorHandler(context.Background(), func(err *HookError) { reported = err })
+	hookErr := errors.New("hook failed")
+
+	err = WithTransactionContext(ctx, db, nil, func(tx Transaction) error {
+		return OnCommit(tx, func() error { return hookErr })
+	})
+	if err != nil {
+		t.Fatalf("committed transaction reported as failed: %v", err)
+	}
+	if reported == nil || reported.Err != nil || len(reported.Hooks) != 1 || reported.Hooks[0] != hookErr {
+		t.Fatalf("hook failure not reported: %v", reported)
+	}
+}
+
+func TestRollbackHookFailure(t *testing.T) {
+	db, err := sql.Open("goat-flaky", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	txErr := errors.New("statement failed")
+	err = WithTransactionContext(context.Background(), db, nil, func(tx Transaction) error {
+		if err := OnRollback(tx, func() error { return errors.New("hook failed") }); err != nil {
+			return err
+		}
+		return txErr
+	})
+
+	var herr *HookError
+	if !errors.As(err, &herr) || !errors.Is(err, txErr) || len(herr.Hooks) != 1 {
+		t.Fatalf("expected a HookError wrapping the transaction error, got %v", err)
+	}
+}